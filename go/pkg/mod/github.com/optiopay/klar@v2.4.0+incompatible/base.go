@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/optiopay/klar/clair"
+	"github.com/optiopay/klar/docker"
+)
+
+// baseImage holds layer digests of KLAR_BASE_IMAGE by platform. Leading
+// layers the scanned image shares with it are inherited from the base.
+type baseImage struct {
+	name   string
+	layers map[string][]string
+}
+
+// pullBaseImage pulls the manifest of KLAR_BASE_IMAGE, every platform of
+// it with KLAR_PLATFORM=all. Layers are not sent to Clair.
+func pullBaseImage(conf *config) (*baseImage, error) {
+	dockerConfig := conf.DockerConfig
+	dockerConfig.ImageName = conf.BaseImage
+	image, err := docker.NewImage(&dockerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse qname: %s", err)
+	}
+	defer image.Close()
+
+	images := []*docker.Image{image}
+	if conf.AllPlatforms {
+		images, err = image.PullPlatforms()
+	} else {
+		err = image.Pull()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't pull image: %s", err)
+	}
+	b := &baseImage{name: conf.BaseImage, layers: make(map[string][]string)}
+	for _, image := range images {
+		// layers of scanned images are compared without empty layers
+		clair.FilterEmptyLayers(image)
+		digests := make([]string, len(image.FsLayers))
+		for i, l := range image.FsLayers {
+			digests[i] = l.BlobSum
+		}
+		b.layers[image.Platform.String()] = digests
+	}
+	return b, nil
+}
+
+// sharedLayers returns the number of leading layers of the scanned image
+// platform which are layers of the base image
+func (b *baseImage) sharedLayers(platform string, layers []string) int {
+	base, ok := b.layers[platform]
+	if !ok && len(b.layers) == 1 {
+		for _, l := range b.layers {
+			base = l
+		}
+	}
+	n := 0
+	for n < len(base) && n < len(layers) && base[n] == layers[n] {
+		n++
+	}
+	return n
+}
+
+// inherited reports whether the vulnerable feature was added by a layer of
+// the base image. Vulnerabilities without a layer, e.g. of Clair API v3,
+// are attributed to the image.
+func (r *report) inherited(v *clair.Vulnerability) bool {
+	digest := r.layerDigest(v)
+	if digest == "" {
+		return false
+	}
+	for _, l := range r.Layers[:r.BaseLayers] {
+		if l == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// introduced returns vulnerabilities added by this image and not found in
+// the baseline, the threshold and the policy apply to them
+func (r *report) introduced() []*clair.Vulnerability {
+	var introduced []*clair.Vulnerability
+	for _, v := range r.added() {
+		if !r.inherited(v) {
+			introduced = append(introduced, v)
+		}
+	}
+	return introduced
+}
+
+// countInherited returns the number of vulnerabilities inherited from the
+// base image which count towards KLAR_BASE_THRESHOLD
+func (r *report) countInherited(conf *config) int {
+	vsNumber := 0
+	for _, v := range r.Vulnerabilities {
+		if conf.counted(v) && !r.unchanged[v] && r.inherited(v) {
+			vsNumber++
+		}
+	}
+	return vsNumber
+}
+
+// baseFailed reports whether inherited vulnerabilities exceed
+// KLAR_BASE_THRESHOLD, they never fail the scan if it isn't set
+func (conf *config) baseFailed(rep *report) bool {
+	return conf.base != nil && conf.BaseThreshold >= 0 && rep.countInherited(conf) > conf.BaseThreshold
+}
+
+// writeBase writes the split between the base image and this image in the
+// text report
+func writeBase(w io.Writer, conf *config, r *report) {
+	if r.BaseLayers == 0 {
+		fmt.Fprintf(w, "Base image %s: no layers in common, all vulnerabilities are introduced by this image\n", conf.base.name)
+		return
+	}
+	inherited := r.countInherited(conf)
+	fmt.Fprintf(w, "Base image %s: %d of %d layers, %d vulnerabilities inherited from base, %d introduced by this image\n",
+		conf.base.name, r.BaseLayers, len(r.Layers), inherited, r.countVulnerabilities(conf))
+	if conf.BaseThreshold >= 0 {
+		fmt.Fprintf(w, "Base threshold: %d inherited vulnerabilities tolerated\n", conf.BaseThreshold)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/optiopay/klar/clair"
+	"github.com/optiopay/klar/docker"
+)
+
+func TestSharedLayers(t *testing.T) {
+	b := &baseImage{name: "debian:9", layers: map[string][]string{
+		"linux/amd64": {"sha256:aaa", "sha256:bbb"},
+		"linux/arm64": {"sha256:ccc"},
+	}}
+	tests := []struct {
+		platform string
+		layers   []string
+		expected int
+	}{
+		{"linux/amd64", []string{"sha256:aaa", "sha256:bbb", "sha256:app"}, 2},
+		{"linux/amd64", []string{"sha256:aaa", "sha256:old", "sha256:app"}, 1},
+		{"linux/amd64", []string{"sha256:app"}, 0},
+		{"linux/arm64", []string{"sha256:ccc", "sha256:app"}, 1},
+		// no base layers of the platform
+		{"linux/s390x", []string{"sha256:aaa"}, 0},
+	}
+	for _, test := range tests {
+		if n := b.sharedLayers(test.platform, test.layers); n != test.expected {
+			t.Errorf("%s %v: expected %d shared layers, got %d", test.platform, test.layers, test.expected, n)
+		}
+	}
+
+	// a base image of one platform applies to any platform
+	single := &baseImage{layers: map[string][]string{"": {"sha256:aaa"}}}
+	if n := single.sharedLayers("linux/amd64", []string{"sha256:aaa", "sha256:app"}); n != 1 {
+		t.Errorf("Expected 1 shared layer, got %d", n)
+	}
+}
+
+func TestPullBaseImageSchemaV1(t *testing.T) {
+	// schema 1 manifests list layers from the top and have empty layers
+	manifest := fmt.Sprintf(`{"schemaVersion": 1, "name": "debian", "tag": "9", "fsLayers": [
+		{"blobSum": "sha256:bbb"}, {"blobSum": "%s"}, {"blobSum": "sha256:aaa"}]}`, clair.EMPTY_LAYER_BLOB_SUM)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/manifests/9") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v1+json")
+		fmt.Fprintln(w, manifest)
+	}))
+	defer ts.Close()
+
+	conf := &config{BaseImage: strings.TrimPrefix(ts.URL, "http://") + "/debian:9",
+		DockerConfig: docker.Config{InsecureRegistry: true, Retries: -1}}
+	b, err := pullBaseImage(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// layers of the scanned image are analysed without empty layers
+	if n := b.sharedLayers("linux/amd64", []string{"sha256:aaa", "sha256:bbb", "sha256:app"}); n != 2 {
+		t.Errorf("Expected 2 shared layers, got %d", n)
+	}
+}
+
+func TestBaseThreshold(t *testing.T) {
+	results := testResults()[:1]
+	rep := results[0].reports[0]
+	// CVE-1 is in the second layer, CVE-2 has no layer
+	rep.BaseLayers = 2
+	conf := &config{ClairOutput: "Low", Threshold: 1, BaseThreshold: -1, base: &baseImage{name: "debian:9"}}
+
+	if !rep.inherited(rep.Vulnerabilities[0]) || rep.inherited(rep.Vulnerabilities[1]) {
+		t.Fatal("Expected only CVE-1 to be inherited")
+	}
+	if counted := rep.countVulnerabilities(conf); counted != 1 {
+		t.Errorf("Expected 1 introduced vulnerability, got %d", counted)
+	}
+	if inherited := rep.countInherited(conf); inherited != 1 {
+		t.Errorf("Expected 1 inherited vulnerability, got %d", inherited)
+	}
+	if conf.failed(rep) {
+		t.Error("Inherited vulnerabilities don't fail the scan without a base threshold")
+	}
+	conf.BaseThreshold = 0
+	if !conf.failed(rep) {
+		t.Error("Expected the base threshold to be exceeded")
+	}
+
+	var buf bytes.Buffer
+	if err := jsonReportFormat(&buf, conf, results); err != nil {
+		t.Fatal(err)
+	}
+	var report jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	base := report.Images[0].Base
+	if base == nil || base.Inherited != 1 || base.Introduced != 1 || !base.Exceeded || base.Threshold == nil {
+		t.Fatalf("Unexpected base %+v", base)
+	}
+	if vs := report.Images[0].Vulnerabilities; vs[0].Origin != "base" || vs[1].Origin != "image" {
+		t.Errorf("Expected CVE-1 from base and CVE-2 from image, got %s and %s", vs[0].Origin, vs[1].Origin)
+	}
+}
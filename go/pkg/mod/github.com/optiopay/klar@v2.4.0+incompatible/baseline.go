@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/optiopay/klar/clair"
+)
+
+// baselineFinding is a vulnerability of the baseline, findings are
+// compared by CVE, package and version
+type baselineFinding struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+}
+
+// baselineKey identifies a baseline image platform, image is empty if
+// the baseline applies to any image
+type baselineKey struct {
+	image    string
+	platform string
+}
+
+// baseline holds findings of a previous report or of the KLAR_BASELINE_IMAGE
+type baseline struct {
+	images map[baselineKey]map[baselineFinding]bool
+}
+
+func newBaselineFinding(v *clair.Vulnerability) baselineFinding {
+	return baselineFinding{Name: v.Name, Severity: v.Severity, Package: v.FeatureName, Version: v.FeatureVersion}
+}
+
+// key drops severity, which Clair may change between scans
+func (f baselineFinding) key() baselineFinding {
+	return baselineFinding{Name: f.Name, Package: f.Package, Version: f.Version}
+}
+
+func (b *baseline) add(key baselineKey, f baselineFinding) {
+	if b.images[key] == nil {
+		b.images[key] = make(map[baselineFinding]bool)
+	}
+	b.images[key][f] = true
+}
+
+// parseBaselineFile reads a JSON report of the current schema version. Findings apply
+// to any image if the report is of one image, e.g. the previous build.
+func parseBaselineFile(path string) (*baseline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read baseline: %s", err)
+	}
+	var rep jsonReport
+	if err := json.Unmarshal(data, &rep); err != nil {
+		return nil, fmt.Errorf("Can't decode baseline %s: %s", path, err)
+	}
+	if rep.SchemaVersion != strconv.Itoa(jsonReportVersion) {
+		return nil, fmt.Errorf("Baseline %s is not a JSON report of schema version %d", path, jsonReportVersion)
+	}
+	names := make(map[string]bool)
+	for _, image := range rep.Images {
+		if image.Error != "" {
+			return nil, fmt.Errorf("Baseline %s has an error for %s: %s", path, image.Image, image.Error)
+		}
+		names[image.Image] = true
+	}
+	b := &baseline{images: make(map[baselineKey]map[baselineFinding]bool)}
+	for _, image := range rep.Images {
+		key := baselineKey{platform: image.Platform}
+		if len(names) > 1 {
+			key.image = image.Image
+		}
+		if b.images[key] == nil {
+			b.images[key] = make(map[baselineFinding]bool)
+		}
+		for _, v := range image.Vulnerabilities {
+			b.add(key, baselineFinding{Name: v.Name, Severity: v.Severity, Package: v.Package.Name, Version: v.Package.Version})
+		}
+	}
+	return b, nil
+}
+
+// scanBaselineImage scans KLAR_BASELINE_IMAGE without the whitelist
+func scanBaselineImage(conf *config) (*baseline, error) {
+	baseConf := *conf
+	baseConf.FormatStyle = "json"
+	baseConf.policy = nil
+	baseConf.base = nil
+	r := &scanResult{image: conf.BaselineImage}
+	scanImage(&baseConf, &vulnerabilitiesWhitelist{}, r)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return newBaselineFromResult(r), nil
+}
+
+// newBaselineFromResult builds the baseline from a scan of KLAR_BASELINE_IMAGE
+func newBaselineFromResult(r *scanResult) *baseline {
+	b := &baseline{images: make(map[baselineKey]map[baselineFinding]bool)}
+	for _, rep := range r.reports {
+		key := baselineKey{platform: rep.Platform}
+		b.images[key] = make(map[baselineFinding]bool)
+		for _, v := range append(append([]*clair.Vulnerability{}, rep.Vulnerabilities...), rep.Whitelisted...) {
+			b.add(key, newBaselineFinding(v))
+		}
+	}
+	return b
+}
+
+// findings returns the baseline of the image platform, nil if there isn't one
+func (b *baseline) findings(image, platform string) map[baselineFinding]bool {
+	for _, key := range []baselineKey{{image, platform}, {"", platform}} {
+		if findings, ok := b.images[key]; ok {
+			return findings
+		}
+	}
+	if len(b.images) == 1 {
+		for _, findings := range b.images {
+			return findings
+		}
+	}
+	return nil
+}
+
+// compareBaseline marks vulnerabilities found in the baseline as unchanged
+// and collects baseline findings which are not found any more. Findings
+// with the same key, e.g. a package in two namespaces, are all unchanged.
+func (r *report) compareBaseline(b *baseline) {
+	r.unchanged = make(map[*clair.Vulnerability]bool)
+	previous := make(map[baselineFinding]baselineFinding)
+	for f := range b.findings(r.Image, r.Platform) {
+		previous[f.key()] = f
+	}
+	current := make(map[baselineFinding]bool)
+	for _, v := range r.Vulnerabilities {
+		key := newBaselineFinding(v).key()
+		if _, ok := previous[key]; ok {
+			r.unchanged[v] = true
+		}
+		current[key] = true
+	}
+	for _, v := range r.Whitelisted {
+		current[newBaselineFinding(v).key()] = true
+	}
+	r.Fixed = make([]baselineFinding, 0, len(previous))
+	for key, f := range previous {
+		if !current[key] {
+			r.Fixed = append(r.Fixed, f)
+		}
+	}
+	sort.Slice(r.Fixed, func(i, j int) bool {
+		if r.Fixed[i].Name != r.Fixed[j].Name {
+			return r.Fixed[i].Name < r.Fixed[j].Name
+		}
+		return r.Fixed[i].Package < r.Fixed[j].Package
+	})
+}
+
+// added returns vulnerabilities which are not in the baseline, all of them
+// without a baseline
+func (r *report) added() []*clair.Vulnerability {
+	if r.unchanged == nil {
+		return r.Vulnerabilities
+	}
+	var added []*clair.Vulnerability
+	for _, v := range r.Vulnerabilities {
+		if !r.unchanged[v] {
+			added = append(added, v)
+		}
+	}
+	return added
+}
+
+// writeBaseline writes the comparison with the baseline in the text report
+func writeBaseline(w io.Writer, r *report) {
+	added := r.added()
+	fmt.Fprintf(w, "Baseline: %d new, %d unchanged, %d fixed vulnerabilities\n",
+		len(added), len(r.Vulnerabilities)-len(added), len(r.Fixed))
+	for _, v := range added {
+		fmt.Fprintf(w, "  new: %s [%s] in %s %s\n", v.Name, v.Severity, v.FeatureName, v.FeatureVersion)
+	}
+	for _, f := range r.Fixed {
+		fmt.Fprintf(w, "  fixed: %s [%s] in %s %s\n", f.Name, f.Severity, f.Package, f.Version)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/optiopay/klar/clair"
+)
+
+func TestParseBaselineFile(t *testing.T) {
+	results := testResults()[:1]
+	var buf bytes.Buffer
+	if err := jsonReportFormat(&buf, &config{ClairOutput: "Low"}, results); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "klar-baseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := parseBaselineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a report of one image applies to any image
+	findings := b.findings("postgres:9.6", "")
+	expected := map[baselineFinding]bool{
+		{Name: "CVE-1", Severity: "High", Package: "openssl", Version: "1.0.2"}: true,
+		{Name: "CVE-2", Severity: "Low", Package: "bash", Version: "4.3"}:       true,
+		{Name: "CVE-3", Severity: "Critical", Package: "zlib", Version: "1.2"}:  true,
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("Expected %v, got %v", expected, findings)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"Vulnerabilities": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseBaselineFile(path); err == nil {
+		t.Error("Expected an error for a report of the old format")
+	}
+}
+
+func TestCompareBaseline(t *testing.T) {
+	b := &baseline{images: map[baselineKey]map[baselineFinding]bool{
+		{"", ""}: {
+			{Name: "CVE-1", Severity: "Medium", Package: "openssl", Version: "1.0.2"}: true,
+			{Name: "CVE-2", Severity: "High", Package: "bash", Version: "4.3"}:        true,
+			{Name: "CVE-3", Severity: "Critical", Package: "zlib", Version: "1.2"}:    true,
+		},
+	}}
+	vs := []*clair.Vulnerability{
+		// severity changed since the baseline
+		{Name: "CVE-1", Severity: "High", FeatureName: "openssl", FeatureVersion: "1.0.2"},
+		// bash was upgraded but is still vulnerable
+		{Name: "CVE-2", Severity: "High", FeatureName: "bash", FeatureVersion: "4.4"},
+		{Name: "CVE-4", Severity: "High", FeatureName: "curl", FeatureVersion: "7.6"},
+	}
+	rep := &report{Image: "app:2.0", Vulnerabilities: vs}
+	rep.compareBaseline(b)
+
+	if added := rep.added(); !reflect.DeepEqual(added, vs[1:]) {
+		t.Errorf("Expected CVE-2 and CVE-4 to be new, got %v", added)
+	}
+	expectedFixed := []baselineFinding{
+		{Name: "CVE-2", Severity: "High", Package: "bash", Version: "4.3"},
+		{Name: "CVE-3", Severity: "Critical", Package: "zlib", Version: "1.2"},
+	}
+	if !reflect.DeepEqual(rep.Fixed, expectedFixed) {
+		t.Errorf("Expected fixed %v, got %v", expectedFixed, rep.Fixed)
+	}
+	if n := rep.countVulnerabilities(&config{ClairOutput: "Low"}); n != 2 {
+		t.Errorf("Expected 2 vulnerabilities counted towards the threshold, got %d", n)
+	}
+
+	// the same finding twice, e.g. in two namespaces, is old debt both times
+	vs = []*clair.Vulnerability{
+		{Name: "CVE-1", Severity: "Medium", NamespaceName: "debian:9", FeatureName: "openssl", FeatureVersion: "1.0.2"},
+		{Name: "CVE-1", Severity: "Medium", NamespaceName: "debian:10", FeatureName: "openssl", FeatureVersion: "1.0.2"},
+	}
+	rep = &report{Image: "app:2.0", Vulnerabilities: vs}
+	rep.compareBaseline(b)
+	if added := rep.added(); len(added) != 0 {
+		t.Errorf("Expected no new vulnerabilities, got %v", added)
+	}
+	if len(rep.Fixed) != 2 || rep.Fixed[0].Name != "CVE-2" || rep.Fixed[1].Name != "CVE-3" {
+		t.Errorf("Expected CVE-2 and CVE-3 fixed, got %v", rep.Fixed)
+	}
+}
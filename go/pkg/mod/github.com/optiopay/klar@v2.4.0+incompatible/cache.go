@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+// defaultCacheTTL is the default of KLAR_CACHE_TTL
+const defaultCacheTTL = time.Hour
+
+// cacheFormat is the version of cache entries. It must be increased when
+// cached results change meaning, e.g. layer names in AddedBy, entries of
+// other versions are not used. Format 2 has layers named by blob chain.
+const cacheFormat = 2
+
+// resultCache keeps vulnerabilities Clair found in KLAR_CACHE_DIR, one file
+// per Clair address and manifest digest. The whitelist, the threshold and
+// the policy are applied to cached results as to fresh ones.
+type resultCache struct {
+	dir string
+	ttl time.Duration
+	// clairUpdated is when Clair data was last updated, entries written
+	// before are stale whatever their age. Zero if unknown.
+	clairUpdated time.Time
+}
+
+// cacheEntry is a cache file
+type cacheEntry struct {
+	Format          int                    `json:"format"`
+	Clair           string                 `json:"clair"`
+	Digest          string                 `json:"digest"`
+	ClairAPIVersion int                    `json:"clairApiVersion"`
+	Created         time.Time              `json:"created"`
+	Vulnerabilities []*clair.Vulnerability `json:"vulnerabilities"`
+}
+
+// parseClairUpdated parses KLAR_CACHE_CLAIR_UPDATED which is either a time
+// as in RFC 3339 or a file whose modification time is the time Clair data
+// was updated, e.g. touched by the job watching the Clair updater
+func parseClairUpdated(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	info, err := os.Stat(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s %s is neither an RFC 3339 time nor a file: %s", optionKlarCacheUpdated, value, err)
+	}
+	return info.ModTime(), nil
+}
+
+func (c *resultCache) path(clairAddr, digest string) string {
+	key := fmt.Sprintf("%d\n%s\n%s", cacheFormat, clairAddr, digest)
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// get returns the entry of the image digest analysed by Clair at clairAddr,
+// nil if there is none or it is stale at now
+func (c *resultCache) get(clairAddr, digest string, now time.Time) *cacheEntry {
+	data, err := ioutil.ReadFile(c.path(clairAddr, digest))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Can't read cached results of %s: %s\n", digest, err)
+		}
+		return nil
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't decode cached results of %s: %s\n", digest, err)
+		return nil
+	}
+	if e.Format != cacheFormat || e.Clair != clairAddr || e.Digest != digest {
+		return nil
+	}
+	if now.Sub(e.Created) > c.ttl || e.Created.Before(c.clairUpdated) {
+		return nil
+	}
+	return &e
+}
+
+// put stores vulnerabilities of the image digest found by Clair at
+// clairAddr. The file is replaced at once, so concurrent scans never read
+// a partial entry.
+func (c *resultCache) put(clairAddr, digest string, version int, vs []*clair.Vulnerability, now time.Time) error {
+	data, err := json.Marshal(&cacheEntry{
+		Format:          cacheFormat,
+		Clair:           clairAddr,
+		Digest:          digest,
+		ClairAPIVersion: version,
+		Created:         now.UTC(),
+		Vulnerabilities: vs,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, ".entry")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), c.path(clairAddr, digest)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
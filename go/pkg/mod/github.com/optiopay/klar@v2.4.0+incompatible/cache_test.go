@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+	"github.com/optiopay/klar/docker"
+)
+
+func TestResultCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &resultCache{dir: dir, ttl: time.Hour}
+	vs := []*clair.Vulnerability{{Name: "CVE-1", Severity: "High", FeatureName: "openssl"}}
+	if err := c.put("http://clair:6060", "sha256:aaa", 1, vs, now); err != nil {
+		t.Fatal(err)
+	}
+
+	e := c.get("http://clair:6060", "sha256:aaa", now.Add(30*time.Minute))
+	if e == nil || e.ClairAPIVersion != 1 || len(e.Vulnerabilities) != 1 || e.Vulnerabilities[0].Name != "CVE-1" {
+		t.Fatalf("Expected cached CVE-1, got %+v", e)
+	}
+	if !e.Created.Equal(now) {
+		t.Errorf("Expected entry created at %s, got %s", now, e.Created)
+	}
+	if e := c.get("http://other-clair:6060", "sha256:aaa", now); e != nil {
+		t.Error("Expected no entry for another Clair")
+	}
+	if e := c.get("http://clair:6060", "sha256:bbb", now); e != nil {
+		t.Error("Expected no entry for another digest")
+	}
+	if e := c.get("http://clair:6060", "sha256:aaa", now.Add(2*time.Hour)); e != nil {
+		t.Error("Expected the entry to expire after the TTL")
+	}
+	c.clairUpdated = now.Add(time.Minute)
+	if e := c.get("http://clair:6060", "sha256:aaa", now.Add(30*time.Minute)); e != nil {
+		t.Error("Expected the entry to be stale after Clair data was updated")
+	}
+	c.clairUpdated = time.Time{}
+
+	// entries of another format are not used even if found at the path
+	data, err := json.Marshal(&cacheEntry{Format: cacheFormat - 1, Clair: "http://clair:6060", Digest: "sha256:aaa", Created: now, Vulnerabilities: vs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.path("http://clair:6060", "sha256:aaa"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if e := c.get("http://clair:6060", "sha256:aaa", now); e != nil {
+		t.Errorf("Expected no entry of format %d", cacheFormat-1)
+	}
+}
+
+func TestCacheBeforeBlobChainNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	c := &resultCache{dir: dir, ttl: time.Hour}
+	// format 1 entries name layers by config and blob digest
+	vs := []*clair.Vulnerability{{Name: "CVE-1", AddedBy: "configlayer"}}
+	data, err := json.Marshal(&cacheEntry{Format: 1, Clair: "http://clair:6060", Digest: "sha256:aaa", Created: now, Vulnerabilities: vs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte("1\nhttp://clair:6060\nsha256:aaa"))))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if e := c.get("http://clair:6060", "sha256:aaa", now); e != nil {
+		t.Error("Expected no entry written before layers were named by blob chain")
+	}
+}
+
+func TestParseClairUpdated(t *testing.T) {
+	if updated, err := parseClairUpdated("2019-06-01T12:00:00Z"); err != nil || !updated.Equal(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected 2019-06-01T12:00:00Z, got %s, %v", updated, err)
+	}
+	f, err := ioutil.TempFile("", "klar-clair-updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	modified := time.Date(2019, 6, 2, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(f.Name(), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := parseClairUpdated(f.Name()); err != nil || !updated.Equal(modified) {
+		t.Errorf("Expected modification time %s, got %s, %v", modified, updated, err)
+	}
+	if _, err := parseClairUpdated("yesterday"); err == nil {
+		t.Error("Expected an error for neither a time nor a file")
+	}
+}
+
+func TestAnalyseCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// nothing listens on the Clair address, results must come from the cache
+	conf := &config{ClairAddr: "http://127.0.0.1:1", ClairOutput: "Low", FormatStyle: "json", Retries: -1,
+		cache: &resultCache{dir: dir, ttl: time.Hour}}
+	scanned := time.Now().Add(-time.Minute).UTC()
+	vs := []*clair.Vulnerability{
+		{Name: "CVE-1", Severity: "High", FeatureName: "openssl"},
+		{Name: "CVE-2", Severity: "Low", FeatureName: "bash"},
+	}
+	if err := conf.cache.put(conf.ClairAddr, "sha256:aaa", 1, vs, scanned); err != nil {
+		t.Fatal(err)
+	}
+	image := &docker.Image{
+		Name:   "library/nginx",
+		Digest: "sha256:aaa",
+		FsLayers: []docker.FsLayer{
+			{BlobSum: clair.EMPTY_LAYER_BLOB_SUM},
+			{BlobSum: "sha256:layer"},
+		},
+	}
+	whitelist, err := newWhitelist(vulnerabilitiesWhitelistYAML{General: []string{"CVE-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, _, err := analyse(conf, whitelist, "nginx", image, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Expected cached results, got %s", err)
+	}
+	if !rep.Cached || !rep.ScanTime.Equal(scanned) || rep.ClairAPIVersion != 1 {
+		t.Errorf("Expected results cached at %s, got %+v", scanned, rep)
+	}
+	if len(rep.Vulnerabilities) != 1 || len(rep.Whitelisted) != 1 {
+		t.Errorf("Expected the whitelist applied to cached results, got %d vulnerabilities", len(rep.Vulnerabilities))
+	}
+	if len(rep.Layers) != 1 {
+		t.Errorf("Expected the empty layer skipped, got %v", rep.Layers)
+	}
+}
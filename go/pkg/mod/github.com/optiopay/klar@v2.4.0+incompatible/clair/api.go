@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -14,28 +16,37 @@ import (
 	"github.com/optiopay/klar/docker"
 	"github.com/optiopay/klar/utils"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 type apiV1 struct {
 	url    string
 	client http.Client
+	ctx    context.Context
 }
 
 type apiV3 struct {
 	url    string
 	client clairpb.AncestryServiceClient
+	ctx    context.Context
 }
 
-func newAPI(url string, version int, timeout time.Duration) (API, error) {
+func newAPI(url string, version int, conf *Config) (API, error) {
 	if version < 3 {
-		return newAPIV1(url, timeout), nil
+		return newAPIV1(url, conf), nil
 	}
-	return newAPIV3(url)
+	return newAPIV3(url, conf)
 }
 
-func newAPIV1(url string, timeout time.Duration) *apiV1 {
+func newAPIV1(url string, conf *Config) *apiV1 {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-		url = fmt.Sprintf("http://%s", url)
+		scheme := "http"
+		if conf.TLS != nil {
+			scheme = "https"
+		}
+		url = fmt.Sprintf("%s://%s", scheme, url)
 	}
 	if strings.LastIndex(url, ":") < 6 {
 		url = fmt.Sprintf("%s:6060", url)
@@ -43,12 +54,13 @@ func newAPIV1(url string, timeout time.Duration) *apiV1 {
 	return &apiV1{
 		url: url,
 		client: http.Client{
-			Timeout: timeout,
+			Transport: utils.NewTransport(conf.TLS, conf.Timeout, conf.Retries, conf.Context),
 		},
+		ctx: conf.context(),
 	}
 }
 
-func newAPIV3(url string) (*apiV3, error) {
+func newAPIV3(url string, conf *Config) (*apiV3, error) {
 	if i := strings.Index(url, "://"); i != -1 {
 		runes := []rune(url)
 		url = string(runes[i+3:])
@@ -56,17 +68,90 @@ func newAPIV3(url string) (*apiV3, error) {
 	if strings.Index(url, ":") == -1 {
 		url = fmt.Sprintf("%s:6060", url)
 	}
-	conn, err := grpc.Dial(url, grpc.WithInsecure())
+	security := grpc.WithInsecure()
+	if conf.TLS != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(conf.TLS))
+	}
+	conn, err := grpc.Dial(url, security, grpc.WithUnaryInterceptor(retryUnary(conf.Timeout, conf.Retries)))
 	if err != nil {
 		return nil, fmt.Errorf("did not connect to %s: %v", url, err)
 	}
 	return &apiV3{
 		url:    url,
-		client: clairpb.NewAncestryServiceClient(conn)}, nil
+		client: clairpb.NewAncestryServiceClient(conn),
+		ctx:    conf.context(),
+	}, nil
 }
 
+// retryUnary limits every attempt of a gRPC call by timeout and repeats
+// calls which failed because Clair was unavailable or the attempt timed out,
+// waiting with exponential backoff and jitter in between. Retries is
+// utils.DefaultRetries if 0 and negative value disables retries.
+func retryUnary(timeout time.Duration, retries int) grpc.UnaryClientInterceptor {
+	if retries == 0 {
+		retries = utils.DefaultRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		for attempt := 0; ; attempt++ {
+			attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout > 0 {
+				attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			err := invoker(attemptCtx, method, req, reply, cc, opts...)
+			cancel()
+			if attempt >= retries || ctx.Err() != nil || !retryableCode(err) {
+				return err
+			}
+			wait := utils.Backoff(attempt)
+			fmt.Fprintf(os.Stderr, "Clair call %s failed, retrying in %s: %s\n", method, wait, err)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// retryableCode reports whether a gRPC call can succeed when repeated,
+// e.g. after Clair restarted
+func retryableCode(err error) bool {
+	s, _ := status.FromError(err)
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// withPhase is utils.WithPhase for gRPC errors, which report timeouts as
+// status codes
+func withPhase(ctx context.Context, phase string, err error) error {
+	if s, _ := status.FromError(err); s.Code() == codes.DeadlineExceeded {
+		return &utils.TimeoutError{Phase: phase, Err: err}
+	}
+	return utils.WithPhase(ctx, phase, err)
+}
+
+// Push posts the layers Clair hasn't indexed yet. Clair indexes a layer
+// only after its parent, so layers below an indexed one are indexed too.
 func (a *apiV1) Push(image *docker.Image) error {
-	for i := 0; i < len(image.FsLayers); i++ {
+	start := 0
+	for i := len(image.FsLayers) - 1; i >= 0; i-- {
+		indexed, err := a.layerIndexed(image.LayerName(i))
+		if err != nil {
+			return err
+		}
+		if indexed {
+			start = i + 1
+			break
+		}
+	}
+	for i := start; i < len(image.FsLayers); i++ {
 		layer := newLayer(image, i)
 		if err := a.pushLayer(layer); err != nil {
 			return err
@@ -75,6 +160,25 @@ func (a *apiV1) Push(image *docker.Image) error {
 	return nil
 }
 
+// layerIndexed reports whether Clair has the layer. Unexpected responses
+// are not errors, the layer is pushed then.
+func (a *apiV1) layerIndexed(name string) (bool, error) {
+	url := fmt.Sprintf("%s/v1/layers/%s", a.url, name)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("can't create a layer request: %s", err)
+	}
+	utils.DumpRequest(request)
+	response, err := a.client.Do(request)
+	if err != nil {
+		return false, utils.WithPhase(a.ctx, "checking layer "+name+" in Clair", err)
+	}
+	utils.DumpResponse(response)
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	return response.StatusCode == http.StatusOK, nil
+}
+
 func (a *apiV1) pushLayer(layer *layer) error {
 	envelope := layerEnvelope{Layer: layer}
 	reqBody, err := json.Marshal(envelope)
@@ -90,7 +194,7 @@ func (a *apiV1) pushLayer(layer *layer) error {
 	utils.DumpRequest(request)
 	response, err := a.client.Do(request)
 	if err != nil {
-		return fmt.Errorf("can't push layer to Clair: %s", err)
+		return utils.WithPhase(a.ctx, "pushing layer "+layer.Name+" to Clair", err)
 	}
 	utils.DumpResponse(response)
 	defer response.Body.Close()
@@ -118,7 +222,7 @@ func (a *apiV1) Analyze(image *docker.Image) ([]*Vulnerability, error) {
 	utils.DumpRequest(request)
 	response, err := a.client.Do(request)
 	if err != nil {
-		return nil, err
+		return nil, utils.WithPhase(a.ctx, "getting vulnerabilities from Clair", err)
 	}
 	utils.DumpResponse(response)
 	defer response.Body.Close()
@@ -128,13 +232,14 @@ func (a *apiV1) Analyze(image *docker.Image) ([]*Vulnerability, error) {
 	}
 	var envelope layerEnvelope
 	if err = json.NewDecoder(response.Body).Decode(&envelope); err != nil {
-		return nil, err
+		return nil, utils.WithPhase(a.ctx, "reading vulnerabilities from Clair", err)
 	}
 	var vs []*Vulnerability
 	for _, f := range envelope.Layer.Features {
 		for _, v := range f.Vulnerabilities {
 			v.FeatureName = f.Name
 			v.FeatureVersion = f.Version
+			v.AddedBy = f.AddedBy
 			//the for loop uses the same variable for "v", reloading with new values
 			//since we are appending a pointer to the variable to the slice, we need to create a copy of the struct
 			//otherwise the slice winds up with multiple pointers to the same struct
@@ -148,7 +253,7 @@ func (a *apiV1) Analyze(image *docker.Image) ([]*Vulnerability, error) {
 func (a *apiV3) Push(image *docker.Image) error {
 	req := &clairpb.PostAncestryRequest{
 		Format:       "Docker",
-		AncestryName: image.Name,
+		AncestryName: ancestryName(image),
 	}
 
 	ls := make([]*clairpb.PostAncestryRequest_PostLayer, len(image.FsLayers))
@@ -156,28 +261,38 @@ func (a *apiV3) Push(image *docker.Image) error {
 		ls[i] = newLayerV3(image, i)
 	}
 	req.Layers = ls
-	_, err := a.client.PostAncestry(context.Background(), req)
-	return err
+	_, err := a.client.PostAncestry(a.ctx, req)
+	return withPhase(a.ctx, "pushing ancestry to Clair", err)
+}
+
+// ancestryName returns the name of the image ancestry in Clair. It is unique
+// to the manifest, so concurrent scans of other tags or platforms of the
+// repository don't replace the ancestry before it is read.
+func ancestryName(image *docker.Image) string {
+	if image.Digest != "" {
+		return image.Name + "@" + image.Digest
+	}
+	return image.Name + "@sha256:" + image.LayerName(len(image.FsLayers)-1)
 }
 
 func newLayerV3(image *docker.Image, index int) *clairpb.PostAncestryRequest_PostLayer {
 	return &clairpb.PostAncestryRequest_PostLayer{
 		Hash:    image.LayerName(index),
 		Path:    strings.Join([]string{image.Registry, image.Name, "blobs", image.FsLayers[index].BlobSum}, "/"),
-		Headers: map[string]string{"Authorization": image.Token},
+		Headers: map[string]string{"Authorization": image.Authorization()},
 	}
 }
 
 func (a *apiV3) Analyze(image *docker.Image) ([]*Vulnerability, error) {
 	req := &clairpb.GetAncestryRequest{
-		AncestryName:        image.Name,
+		AncestryName:        ancestryName(image),
 		WithFeatures:        true,
 		WithVulnerabilities: true,
 	}
 
-	resp, err := a.client.GetAncestry(context.Background(), req)
+	resp, err := a.client.GetAncestry(a.ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, withPhase(a.ctx, "getting vulnerabilities from Clair", err)
 	}
 	var vs []*Vulnerability
 	for _, f := range resp.Ancestry.Features {
@@ -196,7 +311,7 @@ func (a *apiV3) Analyze(image *docker.Image) ([]*Vulnerability, error) {
 }
 
 func convertVulnerability(cv *clairpb.Vulnerability) *Vulnerability {
-	return &Vulnerability{
+	v := &Vulnerability{
 		Name:          cv.Name,
 		NamespaceName: cv.NamespaceName,
 		Description:   cv.Description,
@@ -204,4 +319,9 @@ func convertVulnerability(cv *clairpb.Vulnerability) *Vulnerability {
 		Link:          cv.Link,
 		FixedBy:       cv.FixedBy,
 	}
+	// API v3 returns metadata as a JSON string
+	if cv.Metadata != "" {
+		json.Unmarshal([]byte(cv.Metadata), &v.Metadata)
+	}
+	return v
 }
@@ -32,7 +32,7 @@ func TestNewAPIV1(t *testing.T) {
 		},
 	}
 	for _, tc := range cases {
-		api := newAPIV1(tc.url, time.Minute)
+		api := newAPIV1(tc.url, &Config{Timeout: time.Minute})
 		if api.url != tc.expected {
 			t.Errorf("expected %s got %s", api.url, tc.expected)
 		}
@@ -70,7 +70,7 @@ func TestNewAPIV3(t *testing.T) {
 		},
 	}
 	for _, tc := range cases {
-		api, err := newAPIV3(tc.url)
+		api, err := newAPIV3(tc.url, &Config{})
 		if err != nil {
 			t.Errorf("failed to initialize api v3: %s", err)
 			continue
@@ -1,6 +1,8 @@
 package clair
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
 	"strings"
@@ -53,8 +55,13 @@ type Vulnerability struct {
 	Metadata       map[string]interface{} `json:"Metadata,omitempty"`
 	FixedBy        string                 `json:"FixedBy,omitempty"`
 	FixedIn        []feature              `json:"FixedIn,omitempty"`
-	FeatureName    string                 `json:"FeatureName",omitempty`
-	FeatureVersion string                 `json:"FeatureVersion",omitempty`
+	FeatureName    string                 `json:"FeatureName,omitempty"`
+	FeatureVersion string                 `json:"FeatureVersion,omitempty"`
+	// AddedBy is the name of the layer which added the feature, API v1 only
+	AddedBy string `json:"AddedBy,omitempty"`
+	// Instruction is the Dockerfile instruction which created the AddedBy
+	// layer, klar sets it from the image history
+	Instruction string `json:"Instruction,omitempty"`
 }
 
 type layerError struct {
@@ -70,10 +77,39 @@ type layerEnvelope struct {
 	Error *clairError `json:"Error,omitempty"`
 }
 
+// Config holds options of the connection to Clair
+type Config struct {
+	// Timeout limits every attempt of a request to Clair
+	Timeout time.Duration
+	// Retries is the number of times failed API v1 requests and API v3
+	// calls are repeated, utils.DefaultRetries if 0. Negative value
+	// disables retries.
+	Retries int
+	// Context bounds all requests, e.g. with the scan deadline.
+	// Default is no deadline.
+	Context context.Context
+	// TLS secures API v1 and v3 connections, see LoadTLSConfig. Addresses
+	// without a scheme use https with it.
+	TLS *tls.Config
+}
+
+func (conf *Config) context() context.Context {
+	if conf.Context == nil {
+		return context.Background()
+	}
+	return conf.Context
+}
+
 // NewClair construct Clair entity using potentially incomplete server URL
 // If protocol is missing HTTP will be used. If port is missing 6060 will be used
 func NewClair(url string, version int, timeout time.Duration) Clair {
-	api, err := newAPI(url, version, timeout)
+	return NewClairWithConfig(url, version, &Config{Timeout: timeout})
+}
+
+// NewClairWithConfig constructs Clair entity like NewClair with all
+// connection options
+func NewClairWithConfig(url string, version int, conf *Config) Clair {
+	api, err := newAPI(url, version, conf)
 	if err != nil {
 		panic(fmt.Sprintf("cant't create API client version %d %s: %s", version, url, err))
 	}
@@ -92,7 +128,7 @@ func newLayer(image *docker.Image, index int) *layer {
 		Path:       strings.Join([]string{image.Registry, image.Name, "blobs", image.FsLayers[index].BlobSum}, "/"),
 		ParentName: parentName,
 		Format:     "Docker",
-		Headers:    headers{image.Token},
+		Headers:    headers{image.Authorization()},
 	}
 }
 
@@ -105,11 +141,16 @@ func filterEmptyLayers(fsLayers []docker.FsLayer) (filteredLayers []docker.FsLay
 	return
 }
 
+// FilterEmptyLayers removes layers without files from the image, Clair
+// doesn't analyse them
+func FilterEmptyLayers(image *docker.Image) {
+	image.FsLayers = filterEmptyLayers(image.FsLayers)
+}
+
 // Analyse sent each layer from Docker image to Clair and returns
 // a list of found vulnerabilities
 func (c *Clair) Analyse(image *docker.Image) ([]*Vulnerability, error) {
-	// Filter the empty layers in image
-	image.FsLayers = filterEmptyLayers(image.FsLayers)
+	FilterEmptyLayers(image)
 	layerLength := len(image.FsLayers)
 	if layerLength == 0 {
 		fmt.Fprintf(os.Stderr, "no need to analyse image %s/%s:%s as there is no non-emtpy layer\n",
@@ -124,6 +165,18 @@ func (c *Clair) Analyse(image *docker.Image) ([]*Vulnerability, error) {
 	if err != nil {
 		return nil, fmt.Errorf("analyse image %s/%s:%s failed: %s\n", image.Registry, image.Name, image.Tag, err.Error())
 	}
+	setInstructions(image, vs)
 
 	return vs, nil
 }
+
+// setInstructions sets the instruction of the layer which added the feature
+func setInstructions(image *docker.Image, vs []*Vulnerability) {
+	instructions := make(map[string]string, len(image.FsLayers))
+	for i, l := range image.FsLayers {
+		instructions[image.LayerName(i)] = l.Instruction()
+	}
+	for _, v := range vs {
+		v.Instruction = instructions[v.AddedBy]
+	}
+}
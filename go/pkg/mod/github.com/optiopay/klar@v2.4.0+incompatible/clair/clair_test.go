@@ -10,12 +10,17 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/coreos/clair/api/v3/clairpb"
 	"github.com/optiopay/klar/docker"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 const (
@@ -27,9 +32,14 @@ const (
 	imageToken     = "token"
 )
 
-func clairServerhandler(t *testing.T) http.HandlerFunc {
+// clairServerhandler serves Clair API v1 for dockerImage, indexed are
+// names of layers Clair has. Pushed layers are added to it.
+func clairServerhandler(t *testing.T, indexed map[string]bool) http.HandlerFunc {
+	var mu sync.Mutex
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
 		responseFile := "testdata/clair-get"
 
 		if r.Method == "POST" {
@@ -39,8 +49,8 @@ func clairServerhandler(t *testing.T) http.HandlerFunc {
 				return
 			}
 			layer := envelope.Layer
-			if layer.Name != layerHash {
-				http.Error(w, `{"message": "layer name"}`, http.StatusBadRequest)
+			if indexed[layer.Name] {
+				http.Error(w, `{"message": "layer already indexed"}`, http.StatusBadRequest)
 				return
 			}
 			if layer.Headers.Authorization != imageToken {
@@ -53,14 +63,20 @@ func clairServerhandler(t *testing.T) http.HandlerFunc {
 				return
 			}
 
-			if layer.ParentName != "" && layer.ParentName != layerHash {
+			if layer.ParentName != "" && !indexed[layer.ParentName] {
 				http.Error(w, `{"message": "layer parent name"}`, http.StatusBadRequest)
 				return
 			}
+			indexed[layer.Name] = true
 			w.WriteHeader(http.StatusCreated)
 			responseFile = "testdata/clair-post"
 		} else {
-			if r.URL.Path != fmt.Sprintf("/v1/layers/%s", layerHash) {
+			name := strings.TrimPrefix(r.URL.Path, "/v1/layers/")
+			if !indexed[name] {
+				http.Error(w, `{"Error": {"Message": "the resource cannot be found"}}`, http.StatusNotFound)
+				return
+			}
+			if _, ok := r.URL.Query()["vulnerabilities"]; ok && name != dockerImage.AnalyzedLayerName() {
 				http.Error(w, `{"message": "get path"}`, http.StatusBadRequest)
 				return
 			}
@@ -79,15 +95,16 @@ var dockerImage = &docker.Image{
 	Name:     imageName,
 	Tag:      imageTag,
 	FsLayers: []docker.FsLayer{
-		{layerHash},
-		{emptyLayerHash},
-		{layerHash},
+		{BlobSum: layerHash},
+		{BlobSum: emptyLayerHash},
+		{BlobSum: layerHash},
 	},
 	Token: imageToken,
 }
 
 func TestAnalyseV1(t *testing.T) {
-	ts := httptest.NewServer(clairServerhandler(t))
+	indexed := make(map[string]bool)
+	ts := httptest.NewServer(clairServerhandler(t, indexed))
 	defer ts.Close()
 
 	c := NewClair(ts.URL, 1, time.Minute)
@@ -98,11 +115,71 @@ func TestAnalyseV1(t *testing.T) {
 	if len(vs) != 1 {
 		t.Fatalf("Expected 1 vulnerability, got %d", len(vs))
 	}
+	if vs[0].AddedBy != "17675ec01494d651e1ccf81dc9cf63959ebfeed4f978fddb1666b6ead008ed52" {
+		t.Errorf("Unexpected AddedBy %s", vs[0].AddedBy)
+	}
+	if len(indexed) != 2 {
+		t.Errorf("Expected 2 layers pushed, got %v", indexed)
+	}
+
+	// layers are not pushed again, the server rejects layers it has
+	if _, err := c.Analyse(dockerImage); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushSkipsIndexedLayers(t *testing.T) {
+	image := &docker.Image{
+		Registry: imageRegistry,
+		Name:     imageName,
+		FsLayers: []docker.FsLayer{{BlobSum: layerHash}, {BlobSum: layerHash}, {BlobSum: layerHash}},
+		Token:    imageToken,
+	}
+	// the base layers are indexed, e.g. pushed by the scan of another image
+	indexed := map[string]bool{image.LayerName(0): true, image.LayerName(1): true}
+	var posted []string
+	handler := clairServerhandler(t, indexed)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posted = append(posted, r.URL.Path)
+		}
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	api := newAPIV1(ts.URL, &Config{Timeout: time.Minute})
+	if err := api.Push(image); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 1 || !indexed[image.LayerName(2)] {
+		t.Errorf("Expected only the top layer pushed, got %d pushes", len(posted))
+	}
+}
+
+func TestSetInstructions(t *testing.T) {
+	image := &docker.Image{
+		FsLayers: []docker.FsLayer{
+			{BlobSum: "sha256:aaa", CreatedBy: "/bin/sh -c #(nop) ADD file:123 in / "},
+			{BlobSum: "sha256:bbb", CreatedBy: "/bin/sh -c apt-get install -y openssl"},
+		},
+	}
+	vs := []*Vulnerability{{Name: "CVE-1", AddedBy: image.LayerName(1)}, {Name: "CVE-2"}}
+	setInstructions(image, vs)
+	if vs[0].Instruction != "RUN apt-get install -y openssl" {
+		t.Errorf("Unexpected instruction %q", vs[0].Instruction)
+	}
+	if vs[1].Instruction != "" {
+		t.Errorf("Expected no instruction without AddedBy, got %q", vs[1].Instruction)
+	}
 }
 
 const gAddr = "localhost:60801"
 
-type gServer struct{}
+// gServer keeps hashes of the layers of posted ancestries by name
+type gServer struct {
+	mu         sync.Mutex
+	ancestries map[string][]string
+}
 
 func startGServer() {
 	lis, err := net.Listen("tcp", gAddr)
@@ -110,7 +187,7 @@ func startGServer() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	s := grpc.NewServer()
-	clairpb.RegisterAncestryServiceServer(s, &gServer{})
+	clairpb.RegisterAncestryServiceServer(s, &gServer{ancestries: make(map[string][]string)})
 
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
@@ -123,10 +200,25 @@ func TestMain(m *testing.M) {
 }
 
 func (s *gServer) PostAncestry(ctx context.Context, in *clairpb.PostAncestryRequest) (*clairpb.PostAncestryResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hashes []string
+	for _, l := range in.Layers {
+		hashes = append(hashes, l.Hash)
+	}
+	s.ancestries[in.AncestryName] = hashes
 	return &clairpb.PostAncestryResponse{}, nil
 }
 
 func (s *gServer) GetAncestry(ctx context.Context, in *clairpb.GetAncestryRequest) (*clairpb.GetAncestryResponse, error) {
+	s.mu.Lock()
+	hashes, ok := s.ancestries[in.GetAncestryName()]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("ancestry %s not found", in.GetAncestryName())
+	}
+	// the version tells which ancestry the vulnerabilities are of
+	version := hashes[len(hashes)-1]
 	return &clairpb.GetAncestryResponse{
 		Ancestry: &clairpb.Ancestry{
 			Name: in.GetAncestryName(),
@@ -134,7 +226,7 @@ func (s *gServer) GetAncestry(ctx context.Context, in *clairpb.GetAncestryReques
 				{
 					Name:          "coreutils",
 					NamespaceName: "debian:8",
-					Version:       "8.23-4",
+					Version:       version,
 					Vulnerabilities: []*clairpb.Vulnerability{
 						{
 
@@ -166,3 +258,105 @@ func TestAnalyseV3(t *testing.T) {
 		t.Errorf("unexpected vulnerability name: %s", vs[0].Name)
 	}
 }
+
+func TestAnalyseV3SameRepository(t *testing.T) {
+	images := []*docker.Image{
+		{Registry: imageRegistry, Name: imageName, Tag: "amd64", Digest: "sha256:amd64", FsLayers: []docker.FsLayer{{BlobSum: "sha256:aaa"}}},
+		{Registry: imageRegistry, Name: imageName, Tag: "arm64", Digest: "sha256:arm64", FsLayers: []docker.FsLayer{{BlobSum: "sha256:bbb"}}},
+	}
+	api, err := newAPIV3(gAddr, &Config{Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both images are pushed before either is analysed as in concurrent scans
+	for _, image := range images {
+		if err := api.Push(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, image := range images {
+		vs, err := api.Analyze(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vs) != 1 || vs[0].FeatureVersion != image.LayerName(0) {
+			t.Errorf("Expected vulnerabilities of %s, got %+v", image.Tag, vs)
+		}
+	}
+}
+
+// flakyServer fails the first call of every method as Clair does while it
+// restarts
+type flakyServer struct {
+	*gServer
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+func (s *flakyServer) fail(method string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed[method] {
+		return nil
+	}
+	s.failed[method] = true
+	return status.Error(codes.Unavailable, "transport is closing")
+}
+
+func (s *flakyServer) PostAncestry(ctx context.Context, in *clairpb.PostAncestryRequest) (*clairpb.PostAncestryResponse, error) {
+	if err := s.fail("PostAncestry"); err != nil {
+		return nil, err
+	}
+	return s.gServer.PostAncestry(ctx, in)
+}
+
+func (s *flakyServer) GetAncestry(ctx context.Context, in *clairpb.GetAncestryRequest) (*clairpb.GetAncestryResponse, error) {
+	if err := s.fail("GetAncestry"); err != nil {
+		return nil, err
+	}
+	return s.gServer.GetAncestry(ctx, in)
+}
+
+// flakyAPIV3 returns API v3 client of a new flakyServer
+func flakyAPIV3(t *testing.T, retries int) (*apiV3, func()) {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	clairpb.RegisterAncestryServiceServer(s, &flakyServer{
+		gServer: &gServer{ancestries: make(map[string][]string)},
+		failed:  make(map[string]bool),
+	})
+	go s.Serve(lis)
+	dialer := func(string, time.Duration) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithDialer(dialer), grpc.WithUnaryInterceptor(retryUnary(time.Minute, retries)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &apiV3{url: "bufconn", client: clairpb.NewAncestryServiceClient(conn), ctx: context.Background()}
+	return api, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestAnalyseV3Retries(t *testing.T) {
+	api, stop := flakyAPIV3(t, 1)
+	defer stop()
+	if err := api.Push(dockerImage); err != nil {
+		t.Fatalf("Expected the push retried, got %s", err)
+	}
+	vs, err := api.Analyze(dockerImage)
+	if err != nil {
+		t.Fatalf("Expected the analysis retried, got %s", err)
+	}
+	if len(vs) != 1 {
+		t.Errorf("Expected 1 vulnerability, got %d", len(vs))
+	}
+
+	api, stop = flakyAPIV3(t, -1)
+	defer stop()
+	if err := api.Push(dockerImage); err == nil {
+		t.Error("Expected the push to fail without retries")
+	}
+}
@@ -0,0 +1,25 @@
+package clair
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/optiopay/klar/utils"
+)
+
+// LoadTLSConfig builds the TLS configuration of the connection to Clair.
+// caFile verifies the Clair server certificate instead of system roots,
+// certFile and keyFile authenticate klar to Clair and serverName is
+// expected in the server certificate instead of the host of the address.
+// It returns nil if no file and no server name is given.
+func LoadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" {
+		return nil, nil
+	}
+	conf, err := utils.LoadTLSConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Clair TLS: %s", err)
+	}
+	conf.ServerName = serverName
+	return conf, nil
+}
@@ -0,0 +1,143 @@
+package clair
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key issued by a test CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, ca *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", nil, x509.ExtKeyUsageAny)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "clair.test", ca, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newTestCert(t, "klar", ca, x509.ExtKeyUsageClientAuth).write(t, dir, "klar")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "klar" {
+			t.Error("Expected the klar client certificate")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientCAs:    x509.NewCertPool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.TLS.ClientCAs.AddCert(ca.cert)
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the server certificate is for clair.test, not for the test server address
+	tlsConfig, err := LoadTLSConfig(caFile, certFile, keyFile, "clair.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newAPIV1(ts.URL, &Config{Timeout: time.Minute, Retries: -1, TLS: tlsConfig})
+	resp, err := api.client.Get(api.url)
+	if err != nil {
+		t.Fatalf("Can't connect with mutual TLS: %s", err)
+	}
+	resp.Body.Close()
+
+	// without the client certificate the server rejects klar
+	tlsConfig, err = LoadTLSConfig(caFile, "", "", "clair.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api = newAPIV1(ts.URL, &Config{Timeout: time.Minute, Retries: -1, TLS: tlsConfig})
+	if resp, err := api.client.Get(api.url); err == nil {
+		resp.Body.Close()
+		t.Error("Expected the server to require a client certificate")
+	}
+
+	if _, err := LoadTLSConfig(caFile, certFile, "", ""); err == nil {
+		t.Error("Expected an error for a certificate without a key")
+	}
+	if _, err := LoadTLSConfig(keyFile, "", "", ""); err == nil {
+		t.Error("Expected an error for a CA file without certificates")
+	}
+	if conf, err := LoadTLSConfig("", "", "", ""); conf != nil || err != nil {
+		t.Errorf("Expected no TLS config, got %v, %v", conf, err)
+	}
+}
+
+func TestNewAPIWithTLS(t *testing.T) {
+	conf := &Config{TLS: &tls.Config{}}
+	if api := newAPIV1("clair.test", conf); api.url != "https://clair.test:6060" {
+		t.Errorf("Expected https for an address without a scheme, got %s", api.url)
+	}
+	if _, err := newAPIV3("clair.test", conf); err != nil {
+		t.Errorf("Can't create API v3 client with TLS: %s", err)
+	}
+}
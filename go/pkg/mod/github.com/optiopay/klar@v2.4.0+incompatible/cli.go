@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// version is set at build time with -ldflags "-X main.version=v2.5.0"
+var version = "dev"
+
+const (
+	optionKlarConfig   = "KLAR_CONFIG"
+	optionDockerConfig = "DOCKER_CONFIG"
+	optionDockerHost   = "DOCKER_HOST"
+)
+
+type optionDef struct {
+	key    string
+	bool   bool
+	secret bool
+	usage  string
+}
+
+// optionDefs lists options which can be set with flags and in the config
+// file as well as with environment variables
+var optionDefs = []optionDef{
+	{key: optionClairAddress, usage: "address of Clair server, protocol://host:port"},
+	{key: optionClairOutput, usage: "lowest severity level to output: " + strings.Join(priorities, ", ")},
+	{key: optionClairThreshold, usage: "number of outputted vulnerabilities tolerated before returning 1"},
+	{key: optionClairCAFile, usage: "CA certificates verifying the Clair server, PEM"},
+	{key: optionClairCertFile, usage: "client certificate authenticating klar to Clair, PEM"},
+	{key: optionClairKeyFile, usage: "key of the Clair client certificate, PEM"},
+	{key: optionClairServerName, usage: "name expected in the Clair server certificate"},
+	{key: optionClairTimeout, usage: "timeout of Clair requests, e.g. 90s or 5m, numbers are minutes"},
+	{key: optionDockerUser, usage: "Docker registry account name"},
+	{key: optionDockerPassword, secret: true, usage: "Docker registry account password"},
+	{key: optionDockerToken, secret: true, usage: "Docker registry account token"},
+	{key: optionDockerConfig, usage: "directory with Docker config.json"},
+	{key: optionDockerHost, usage: "Docker Engine API address for docker-daemon: images"},
+	{key: optionDockerInsecure, bool: true, usage: "allow registries with bad SSL certificates"},
+	{key: optionDockerTimeout, usage: "timeout of registry requests, e.g. 90s or 5m, numbers are minutes"},
+	{key: optionRegistryInsecure, bool: true, usage: "allow insecure registries (HTTP only)"},
+	{key: optionKlarRegistries, usage: "path to the YAML file with CA bundles, client certificates and mirrors of registries"},
+	{key: optionJSONOutput, bool: true, usage: "output JSON, overrides format-output"},
+	{key: optionFormatOutput, usage: "output format: " + strings.Join(formatTypes, ", ")},
+	{key: optionKlarJSONVersion, usage: "JSON report schema version, 1 for the format before versioned reports"},
+	{key: optionFormatTemplate, usage: "path to the Go text/template file for the template format"},
+	{key: optionWhiteListFile, usage: "path to the YAML file with the CVE whitelist"},
+	{key: optionIgnoreUnfixed, bool: true, usage: "do not count vulnerabilities without a fix towards the threshold"},
+	{key: optionKlarPolicy, usage: "path to the YAML policy file, replaces clair-threshold"},
+	{key: optionKlarBaseline, usage: "previous JSON report, only new vulnerabilities count towards the threshold and policy"},
+	{key: optionKlarBaselineImg, usage: "image whose vulnerabilities don't count towards the threshold and policy"},
+	{key: optionKlarBaseImage, usage: "base image, vulnerabilities of its layers don't count towards the threshold and policy"},
+	{key: optionKlarBaseThresh, usage: "number of vulnerabilities inherited from the base image tolerated, unlimited if not set"},
+	{key: optionKlarScanTimeout, usage: "deadline of the whole scan, e.g. 30m, no deadline if not set"},
+	{key: optionKlarRetries, usage: "number of times failed registry and Clair requests are repeated, 0 disables retries"},
+	{key: optionKlarCacheDir, usage: "directory caching Clair results by manifest digest, no cache if not set"},
+	{key: optionKlarCacheTTL, usage: "how long cached results are used, e.g. 90s or 5m, numbers are minutes"},
+	{key: optionKlarCacheUpdated, usage: "time Clair data was last updated, RFC 3339 or a file whose modification time it is"},
+	{key: optionKlarImagesFrom, usage: "file with images to scan, one per line"},
+	{key: optionKlarWorkers, usage: "number of images scanned at the same time"},
+	{key: optionKlarPlatform, usage: "platform of a multi-arch image, os/arch[/variant] or all"},
+	{key: optionKlarServeAddr, usage: "listen address of the server providing local images to Clair"},
+	{key: optionKlarServeURL, usage: "URL Clair uses to reach the server providing local images"},
+	{key: optionKlarProxy, bool: true, usage: "proxy registry layers to Clair"},
+	{key: optionKlarTrace, bool: true, usage: "dump HTTP requests and responses"},
+}
+
+// flagValues and fileValues hold options set on the command line
+// and in the config file by environment variable name
+var (
+	flagValues = make(map[string]string)
+	fileValues = make(map[string]string)
+)
+
+// getOption returns the value of an option. Flags take precedence over
+// environment variables, which take precedence over the config file.
+func getOption(key string) string {
+	if val, ok := flagValues[key]; ok {
+		return val
+	}
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fileValues[key]
+}
+
+// optionName returns the flag and config file key of an option,
+// e.g. clair-addr for CLAIR_ADDR and platform for KLAR_PLATFORM
+func optionName(key string) string {
+	key = strings.TrimPrefix(key, "KLAR_")
+	return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+// optionFlag stores the flag value in flagValues
+type optionFlag struct {
+	key    string
+	isBool bool
+}
+
+func (f *optionFlag) String() string {
+	return ""
+}
+
+func (f *optionFlag) Set(val string) error {
+	flagValues[f.key] = val
+	return nil
+}
+
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+type command struct {
+	// name is scan, version or config print
+	name string
+	args []string
+}
+
+const usageHeader = `Usage:
+  klar [scan] [flags] IMAGE...
+  klar config print [flags]
+  klar version
+
+Images named version, config or scan must follow the scan command,
+e.g. klar scan version.
+
+Flags take precedence over environment variables, which take precedence
+over the config file. Every flag has an environment variable, e.g.
+--clair-addr is CLAIR_ADDR and --platform is KLAR_PLATFORM.
+
+Flags:
+`
+
+// parseCommandLine parses arguments without the program name. Arguments
+// without a command are scanned for compatibility with older versions.
+func parseCommandLine(args []string) (*command, error) {
+	cmd := &command{name: "scan"}
+	if len(args) > 0 {
+		switch args[0] {
+		case "version":
+			cmd.name = "version"
+			return cmd, nil
+		case "config":
+			if len(args) < 2 || args[1] != "print" {
+				return nil, fmt.Errorf("Unknown config command, only config print is supported")
+			}
+			cmd.name, args = "config print", args[2:]
+		case "scan":
+			args = args[1:]
+		}
+	}
+	var err error
+	if cmd.args, err = parseFlags(cmd.name, args); err != nil {
+		return nil, err
+	}
+	if path := getOption(optionKlarConfig); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// parseFlags parses flags, which may follow positional arguments,
+// and returns positional arguments
+func parseFlags(name string, args []string) ([]string, error) {
+	fs := flag.NewFlagSet("klar "+name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Usage = func() {
+		fs.SetOutput(os.Stderr)
+		fmt.Fprint(os.Stderr, usageHeader)
+		fs.PrintDefaults()
+	}
+	fs.Var(&optionFlag{key: optionKlarConfig}, optionName(optionKlarConfig), "path to the YAML config file")
+	for _, def := range optionDefs {
+		fs.Var(&optionFlag{key: def.key, isBool: def.bool}, optionName(def.key), def.usage)
+	}
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err != flag.ErrHelp {
+				err = fmt.Errorf("%s, run klar %s -h for usage", err, name)
+			}
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// loadConfigFile reads options from a YAML file with flag names as keys:
+//
+//	clair-addr: http://clair:6060
+//	clair-threshold: 10
+func loadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Can't read config file: %s", err)
+	}
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("Can't decode config file %s: %s", path, err)
+	}
+	for name, val := range values {
+		def := findOption(name)
+		if def == nil {
+			return fmt.Errorf("Unknown option %s in config file %s", name, path)
+		}
+		switch val.(type) {
+		case nil:
+		case []interface{}, map[interface{}]interface{}:
+			return fmt.Errorf("Option %s in config file %s is not a single value", name, path)
+		default:
+			fileValues[def.key] = fmt.Sprint(val)
+		}
+	}
+	return nil
+}
+
+func findOption(name string) *optionDef {
+	for i := range optionDefs {
+		if optionName(optionDefs[i].key) == name {
+			return &optionDefs[i]
+		}
+	}
+	return nil
+}
+
+// printConfig writes effective options in the config file format,
+// secrets are masked
+func printConfig(w io.Writer) error {
+	var out yaml.MapSlice
+	for _, def := range optionDefs {
+		val := getOption(def.key)
+		if val == "" {
+			continue
+		}
+		if def.secret {
+			val = "********"
+		} else if u, err := url.Parse(val); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "********")
+				val = u.String()
+			}
+		}
+		out = append(out, yaml.MapItem{Key: optionName(def.key), Value: val})
+	}
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
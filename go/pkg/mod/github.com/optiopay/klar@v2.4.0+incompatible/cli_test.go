@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func resetOptions() {
+	flagValues = make(map[string]string)
+	fileValues = make(map[string]string)
+}
+
+func TestParseCommandLine(t *testing.T) {
+	cases := []struct {
+		args       []string
+		name       string
+		positional []string
+		flags      map[string]string
+		shouldFail bool
+	}{
+		{
+			args:       []string{"postgres:9.5.1"},
+			name:       "scan",
+			positional: []string{"postgres:9.5.1"},
+			flags:      map[string]string{},
+		},
+		{
+			args:       []string{"scan", "--clair-addr", "clair:6060", "postgres", "--docker-insecure", "--platform=linux/arm64"},
+			name:       "scan",
+			positional: []string{"postgres"},
+			flags: map[string]string{
+				optionClairAddress:   "clair:6060",
+				optionDockerInsecure: "true",
+				optionKlarPlatform:   "linux/arm64",
+			},
+		},
+		{
+			args:  []string{"version"},
+			name:  "version",
+			flags: map[string]string{},
+		},
+		{
+			args:  []string{"config", "print", "-clair-threshold", "10"},
+			name:  "config print",
+			flags: map[string]string{optionClairThreshold: "10"},
+		},
+		{
+			args:       []string{"config"},
+			shouldFail: true,
+		},
+		{
+			args:       []string{"scan", "--clair-adr", "clair", "postgres"},
+			shouldFail: true,
+		},
+		{
+			args:  []string{},
+			name:  "scan",
+			flags: map[string]string{},
+		},
+		// images named like commands are scanned with the scan command
+		{
+			args:       []string{"scan", "version"},
+			name:       "scan",
+			positional: []string{"version"},
+			flags:      map[string]string{},
+		},
+		{
+			args:       []string{"scan", "config", "scan"},
+			name:       "scan",
+			positional: []string{"config", "scan"},
+			flags:      map[string]string{},
+		},
+	}
+	for _, tc := range cases {
+		resetOptions()
+		cmd, err := parseCommandLine(tc.args)
+		if (err != nil) != tc.shouldFail {
+			t.Fatalf("%v: unexpected error %v", tc.args, err)
+		}
+		if tc.shouldFail {
+			continue
+		}
+		if cmd.name != tc.name {
+			t.Errorf("%v: expected command %s, got %s", tc.args, tc.name, cmd.name)
+		}
+		if !reflect.DeepEqual(cmd.args, tc.positional) {
+			t.Errorf("%v: expected arguments %v, got %v", tc.args, tc.positional, cmd.args)
+		}
+		if !reflect.DeepEqual(flagValues, tc.flags) {
+			t.Errorf("%v: expected flags %v, got %v", tc.args, tc.flags, flagValues)
+		}
+	}
+	resetOptions()
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "klar.yaml")
+	config := "clair-addr: file:6060\nclair-threshold: 10\ndocker-password: secret\nplatform: all\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer resetOptions()
+	defer os.Unsetenv(optionClairThreshold)
+	defer os.Unsetenv(optionClairAddress)
+	os.Setenv(optionClairAddress, "env:6060")
+	os.Setenv(optionClairThreshold, "5")
+
+	resetOptions()
+	if _, err := parseCommandLine([]string{"--config", path, "--clair-addr", "flag:6060", "postgres"}); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		optionClairAddress:   "flag:6060",
+		optionClairThreshold: "5",
+		optionKlarPlatform:   "all",
+	} {
+		if val := getOption(key); val != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, val)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := printConfig(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), "clair-addr: flag:6060") {
+		t.Errorf("Unexpected config output:\n%s", out.String())
+	}
+
+	if err := ioutil.WriteFile(path, []byte("clair-adr: clair\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resetOptions()
+	if _, err := parseCommandLine([]string{"--config", path, "postgres"}); err == nil {
+		t.Error("Expected an error for an unknown option in the config file")
+	}
+
+	for _, config := range []string{"platform: [linux/amd64, linux/arm64]\n", "clair-addr:\n  host: clair\n"} {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		resetOptions()
+		_, err := parseCommandLine([]string{"--config", path, "postgres"})
+		if err == nil || !strings.Contains(err.Error(), strings.SplitN(config, ":", 2)[0]) {
+			t.Errorf("Expected an error naming the option of %q, got %v", config, err)
+		}
+	}
+}
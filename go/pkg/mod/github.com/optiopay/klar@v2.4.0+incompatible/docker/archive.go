@@ -0,0 +1,221 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// dockerArchive is an image saved with docker save. The tar is indexed
+// once and blobs are read from it in place.
+type dockerArchive struct {
+	path      string
+	reference string
+	file      *os.File
+	entries   map[string]tarEntry
+	// blobs maps layer digest to the tar entry
+	blobs map[string]string
+}
+
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// archiveManifest is an entry of manifest.json in docker save output
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageConfig is the part of the image configuration klar uses
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []historyEntry `json:"history"`
+}
+
+// countingReader tracks the offset of tar entries in the archive
+type countingReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+func (a *dockerArchive) load(image *Image) error {
+	if err := a.index(); err != nil {
+		return err
+	}
+	data, err := a.read("manifest.json")
+	if err != nil {
+		return err
+	}
+	var manifests []archiveManifest
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return fmt.Errorf("Can't decode manifest.json in %s: %s", a.path, err)
+	}
+	m, err := a.selectManifest(manifests)
+	if err != nil {
+		return err
+	}
+
+	configData, err := a.read(m.Config)
+	if err != nil {
+		return err
+	}
+	var config imageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("Can't decode image config in %s: %s", a.path, err)
+	}
+
+	// uncompressed layers are addressed by their diff ids,
+	// newer Docker versions store them as OCI blobs
+	a.blobs = make(map[string]string)
+	image.FsLayers = make([]FsLayer, len(m.Layers))
+	for i, l := range m.Layers {
+		digest := blobPathDigest(l)
+		if digest == "" {
+			if i >= len(config.RootFS.DiffIDs) {
+				return fmt.Errorf("Can't find digest of layer %s in %s", l, a.path)
+			}
+			digest = config.RootFS.DiffIDs[i]
+		}
+		a.blobs[digest] = l
+		image.FsLayers[i].BlobSum = digest
+	}
+	if err := image.setHistory(configData); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't get history of %s: %s\n", a.path, err)
+	}
+	image.configDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(configData))
+	image.schemaVersion = 2
+	if len(m.RepoTags) > 0 {
+		if ref, err := ParseReference(m.RepoTags[0]); err == nil {
+			image.Name, image.Tag = ref.Path, ref.Tag
+		}
+	}
+	return nil
+}
+
+// index records offsets of all regular files in the archive
+func (a *dockerArchive) index() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("Can't open archive: %s", err)
+	}
+	a.file = f
+	br := bufio.NewReader(f)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return fmt.Errorf("Archive %s is compressed, only uncompressed docker save output is supported", a.path)
+	}
+	// bufio reads ahead, so offsets are counted above it
+	counter := &countingReader{r: br}
+	tr := tar.NewReader(counter)
+	a.entries = make(map[string]tarEntry)
+	links := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Can't read archive %s: %s", a.path, err)
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			a.entries[name] = tarEntry{offset: counter.offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			// docker save links identical layers
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		}
+	}
+	for name, target := range links {
+		if e, ok := a.entries[target]; ok {
+			a.entries[name] = e
+		}
+	}
+	return nil
+}
+
+func (a *dockerArchive) selectManifest(manifests []archiveManifest) (*archiveManifest, error) {
+	if a.reference == "" {
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("Archive %s contains %d images, select one with docker-archive:path:name:tag", a.path, len(manifests))
+		}
+		return &manifests[0], nil
+	}
+	wanted, err := ParseReference(a.reference)
+	if err != nil {
+		return nil, err
+	}
+	for i := range manifests {
+		for _, tag := range manifests[i].RepoTags {
+			if ref, err := ParseReference(tag); err == nil && ref == wanted {
+				return &manifests[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Image %s not found in archive %s", a.reference, a.path)
+}
+
+func (a *dockerArchive) section(name string) (*io.SectionReader, error) {
+	e, ok := a.entries[path.Clean(name)]
+	if !ok {
+		return nil, fmt.Errorf("File %s not found in archive %s", name, a.path)
+	}
+	return io.NewSectionReader(a.file, e.offset, e.size), nil
+}
+
+func (a *dockerArchive) read(name string) ([]byte, error) {
+	r, err := a.section(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (a *dockerArchive) openBlob(digest string) (io.ReadCloser, int64, error) {
+	name, ok := a.blobs[digest]
+	if !ok {
+		return nil, 0, fmt.Errorf("Blob %s is not a layer of the image", digest)
+	}
+	r, err := a.section(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(r), r.Size(), nil
+}
+
+func (a *dockerArchive) close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// blobPathDigest converts blobs/<algorithm>/<hex> path to a digest
+func blobPathDigest(p string) string {
+	parts := strings.Split(path.Clean(p), "/")
+	if len(parts) != 3 || parts[0] != "blobs" {
+		return ""
+	}
+	digest := parts[1] + ":" + parts[2]
+	if !isDigest(digest) {
+		return ""
+	}
+	return digest
+}
@@ -0,0 +1,129 @@
+package docker
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestArchive creates docker save output with two layers, the second
+// layer is a symlink to the first one as docker does for identical layers
+func writeTestArchive(t *testing.T, dir string) (string, []byte) {
+	layer := []byte("layer content")
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	config := []byte(fmt.Sprintf(`{"rootfs": {"type": "layers", "diff_ids": ["%s", "%s"]}}`, diffID, diffID))
+	manifest := []byte(`[{"Config": "config.json", "RepoTags": ["flask-lab-training:latest"], "Layers": ["aaa/layer.tar", "bbb/layer.tar"]}]`)
+
+	path := filepath.Join(dir, "image.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{
+		{"config.json", config},
+		{"aaa/layer.tar", layer},
+		{"manifest.json", manifest},
+	} {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg})
+		tw.Write(e.data)
+	}
+	tw.WriteHeader(&tar.Header{Name: "bbb/layer.tar", Linkname: "../aaa/layer.tar", Typeflag: tar.TypeSymlink})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path, layer
+}
+
+func TestDockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, layer := writeTestArchive(t, dir)
+
+	image, err := NewImage(&Config{ImageName: "docker-archive:" + path, ServeAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !image.IsLocal() {
+		t.Fatal("Expected a local image")
+	}
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't load archive: %s", err)
+	}
+	defer image.Close()
+	if image.Name != "library/flask-lab-training" || image.Tag != "latest" {
+		t.Errorf("Unexpected image name %s:%s", image.Name, image.Tag)
+	}
+	if len(image.FsLayers) != 2 {
+		t.Fatalf("Expected 2 fsLayers, got %d", len(image.FsLayers))
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/%s/blobs/%s", image.Registry, image.Name, image.FsLayers[1].BlobSum))
+	if err != nil {
+		t.Fatalf("Can't get layer from blob server: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != string(layer) {
+		t.Fatalf("Unexpected blob response %d: %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(image.Registry + "/local/blobs/sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("other"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown blob, got %d", resp.StatusCode)
+	}
+
+	// the blob server serves layers only with the token of the scan
+	u, err := url.Parse(image.Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/v2", "/0123456789abcdef0123456789abcdef/v2"} {
+		resp, err = http.Get(fmt.Sprintf("http://%s%s/%s/blobs/%s", u.Host, path, image.Name, image.FsLayers[1].BlobSum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s without the token, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestDockerArchiveReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, _ := writeTestArchive(t, dir)
+
+	image, _ := NewImage(&Config{ImageName: "docker-archive:" + path + ":flask-lab-training", ServeAddr: "127.0.0.1:0"})
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't load archive: %s", err)
+	}
+	image.Close()
+
+	image, _ = NewImage(&Config{ImageName: "docker-archive:" + path + ":other:latest"})
+	if err := image.Pull(); err == nil {
+		t.Fatal("Expected an error for a missing image")
+	}
+	image.Close()
+}
@@ -0,0 +1,393 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/optiopay/klar/utils"
+)
+
+const (
+	// minTokenLifetime is used when token response has no or too small expires_in,
+	// see https://docs.docker.com/registry/spec/auth/token/
+	minTokenLifetime = 60 * time.Second
+	// tokenLeeway makes tokens expire a bit earlier to survive clock skew
+	// and the time Clair needs to start downloading a layer
+	tokenLeeway = 10 * time.Second
+	// oauthClientID identifies klar in OAuth2 token requests
+	oauthClientID = "klar"
+)
+
+// challenge is an authentication challenge from Www-Authenticate header
+type challenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// bearerScope identifies a token on the authorization server
+type bearerScope struct {
+	Realm   string
+	Service string
+	Scopes  []string
+}
+
+func (s bearerScope) key() string {
+	return strings.Join([]string{s.Realm, s.Service, strings.Join(s.Scopes, " ")}, "|")
+}
+
+type bearerToken struct {
+	token   string
+	expires time.Time
+}
+
+// tokenResponse is a response of the token endpoint. Docker token
+// authentication returns token, OAuth2 returns access_token.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+}
+
+// authenticator gets tokens from registry authorization servers
+// and caches them. It is shared by all requests of an image.
+type authenticator struct {
+	client *http.Client
+	// basic is Basic Authorization header built from the user credentials
+	basic         string
+	user          string
+	identityToken string
+
+	mu     sync.Mutex
+	tokens map[string]bearerToken
+}
+
+func newAuthenticator(client *http.Client, user, password, token, identityToken string) *authenticator {
+	a := &authenticator{
+		client:        client,
+		user:          user,
+		identityToken: identityToken,
+		tokens:        make(map[string]bearerToken),
+	}
+	if token != "" {
+		a.basic = "Basic " + token
+		if decoded, err := base64.StdEncoding.DecodeString(token); err == nil && a.user == "" {
+			a.user = strings.SplitN(string(decoded), ":", 2)[0]
+		}
+	} else if user != "" {
+		a.basic = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+	return a
+}
+
+// parseChallenges parses Www-Authenticate headers. A header may hold several
+// challenges and parameters may come in any order, e.g.
+// Bearer realm="https://auth.docker.io/token",scope="repository:a:pull",service="registry.docker.io"
+func parseChallenges(headers []string) []challenge {
+	var challenges []challenge
+	for _, h := range headers {
+		p := &headerParser{s: h}
+		var current *challenge
+		for {
+			p.skipSpace()
+			if p.done() {
+				break
+			}
+			token := p.token()
+			if token == "" {
+				// skip a malformed character
+				p.pos++
+				continue
+			}
+			p.skipSpace()
+			if p.peek() != '=' {
+				// a new challenge starts with an auth scheme
+				challenges = append(challenges, challenge{
+					Scheme: strings.ToLower(token),
+					Params: make(map[string]string),
+				})
+				current = &challenges[len(challenges)-1]
+				continue
+			}
+			p.pos++
+			p.skipSpace()
+			value := p.value()
+			if current != nil {
+				current.Params[strings.ToLower(token)] = value
+			}
+			p.skipSpace()
+			if p.peek() == ',' {
+				p.pos++
+			}
+		}
+	}
+	return challenges
+}
+
+type headerParser struct {
+	s   string
+	pos int
+}
+
+func (p *headerParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *headerParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *headerParser) skipSpace() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == ',') {
+		p.pos++
+	}
+}
+
+func (p *headerParser) token() string {
+	start := p.pos
+	for !p.done() && !strings.ContainsRune(" \t,=\"", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// value reads a token or a quoted string with backslash escapes
+func (p *headerParser) value() string {
+	if p.peek() != '"' {
+		start := p.pos
+		for !p.done() && p.s[p.pos] != ',' && p.s[p.pos] != ' ' {
+			p.pos++
+		}
+		return p.s[start:p.pos]
+	}
+	p.pos++
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && !p.done():
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case c == '"':
+			return b.String()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// authorize returns Authorization header value satisfying one of the challenges.
+// If refresh is set the cached token is not used.
+func (a *authenticator) authorize(challenges []challenge, repository string, refresh bool) (string, *bearerScope, error) {
+	for _, c := range challenges {
+		if c.Scheme != "bearer" {
+			continue
+		}
+		realm := c.Params["realm"]
+		if realm == "" {
+			return "", nil, fmt.Errorf("Bearer challenge without realm")
+		}
+		scope := &bearerScope{
+			Realm:   realm,
+			Service: c.Params["service"],
+			Scopes:  strings.Fields(c.Params["scope"]),
+		}
+		if len(scope.Scopes) == 0 {
+			scope.Scopes = []string{fmt.Sprintf("repository:%s:pull", repository)}
+		}
+		sort.Strings(scope.Scopes)
+		token, err := a.bearer(*scope, refresh)
+		if err != nil {
+			return "", nil, err
+		}
+		return token, scope, nil
+	}
+	for _, c := range challenges {
+		if c.Scheme == "basic" && a.basic != "" {
+			return a.basic, nil, nil
+		}
+	}
+	if len(challenges) == 0 {
+		return "", nil, fmt.Errorf("Empty Www-Authenticate")
+	}
+	return "", nil, fmt.Errorf("Unsupported authentication scheme %s or no credentials", challenges[0].Scheme)
+}
+
+// bearer returns Bearer Authorization header for the scope,
+// cached tokens are reused until they expire
+func (a *authenticator) bearer(scope bearerScope, refresh bool) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := scope.key()
+	if t, ok := a.tokens[key]; ok && !refresh && time.Now().Add(tokenLeeway).Before(t.expires) {
+		return "Bearer " + t.token, nil
+	}
+	t, err := a.requestToken(scope)
+	if err != nil {
+		return "", err
+	}
+	a.tokens[key] = t
+	return "Bearer " + t.token, nil
+}
+
+// requestToken gets a token using OAuth2 refresh token flow if there is
+// an identity token and Docker token authentication with GET otherwise
+func (a *authenticator) requestToken(scope bearerScope) (bearerToken, error) {
+	if a.identityToken != "" {
+		t, err := a.postToken(scope)
+		// not every authorization server supports OAuth2
+		if err != errOAuthNotSupported || a.basic == "" {
+			return t, err
+		}
+	}
+	return a.getToken(scope)
+}
+
+var errOAuthNotSupported = fmt.Errorf("OAuth2 token endpoint is not supported")
+
+func (a *authenticator) getToken(scope bearerScope) (bearerToken, error) {
+	params := url.Values{}
+	if scope.Service != "" {
+		params.Set("service", scope.Service)
+	}
+	for _, s := range scope.Scopes {
+		params.Add("scope", s)
+	}
+	if a.user != "" {
+		params.Set("account", a.user)
+	}
+	u, err := withQuery(scope.Realm, params)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	resp, err := checkRateLimited(a.client, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if a.basic != "" {
+			req.Header.Set("Authorization", a.basic)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return bearerToken{}, err
+	}
+	defer resp.Body.Close()
+	return a.decodeToken(resp)
+}
+
+func (a *authenticator) postToken(scope bearerScope) (bearerToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", a.identityToken)
+	form.Set("client_id", oauthClientID)
+	form.Set("access_type", "offline")
+	if scope.Service != "" {
+		form.Set("service", scope.Service)
+	}
+	form.Set("scope", strings.Join(scope.Scopes, " "))
+	resp, err := checkRateLimited(a.client, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", scope.Realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return bearerToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		io.Copy(ioutil.Discard, resp.Body)
+		return bearerToken{}, errOAuthNotSupported
+	}
+	return a.decodeToken(resp)
+}
+
+func (a *authenticator) decodeToken(resp *http.Response) (bearerToken, error) {
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return bearerToken{}, fmt.Errorf("Token request returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		fmt.Fprintln(os.Stderr, "Token response decode error")
+		return bearerToken{}, err
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return bearerToken{}, fmt.Errorf("Token response has neither token nor access_token")
+	}
+	if tr.RefreshToken != "" {
+		// authorization servers may rotate refresh tokens
+		a.identityToken = tr.RefreshToken
+	}
+	lifetime := time.Duration(tr.ExpiresIn) * time.Second
+	if lifetime < minTokenLifetime {
+		lifetime = minTokenLifetime
+	}
+	issued := time.Now()
+	if t, err := time.Parse(time.RFC3339, tr.IssuedAt); err == nil && t.Before(issued) {
+		issued = t
+	}
+	return bearerToken{token: token, expires: issued.Add(lifetime)}, nil
+}
+
+func withQuery(realm string, params url.Values) (string, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("Invalid token realm %s: %s", realm, err)
+	}
+	q := u.Query()
+	for k, vs := range params {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// checkRateLimited sends a request built by newReq and turns a final 429
+// Too Many Requests into an error. It doesn't wait or retry, the transport
+// retries 429 responses after Retry-After before.
+func checkRateLimited(client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't create a request")
+		return nil, err
+	}
+	utils.DumpRequest(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	utils.DumpResponse(resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Registry rate limit exceeded for %s", req.URL.Host)
+	}
+	return resp, nil
+}
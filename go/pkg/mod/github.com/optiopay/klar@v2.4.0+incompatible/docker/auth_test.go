@@ -0,0 +1,149 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	cases := map[string]struct {
+		headers  []string
+		expected []challenge
+	}{
+		"docker_hub": {
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/postgres:pull"`},
+			expected: []challenge{{Scheme: "bearer", Params: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/postgres:pull",
+			}}},
+		},
+		"any_order_no_scope": {
+			headers: []string{`Bearer service="harbor-registry", realm="https://harbor/service/token"`},
+			expected: []challenge{{Scheme: "bearer", Params: map[string]string{
+				"realm":   "https://harbor/service/token",
+				"service": "harbor-registry",
+			}}},
+		},
+		"multiple_scopes": {
+			headers: []string{`Bearer realm="https://r/token",scope="repository:a:pull repository:b:pull",error="insufficient_scope"`},
+			expected: []challenge{{Scheme: "bearer", Params: map[string]string{
+				"realm": "https://r/token",
+				"scope": "repository:a:pull repository:b:pull",
+				"error": "insufficient_scope",
+			}}},
+		},
+		"multiple_challenges": {
+			headers: []string{`Basic realm="Registry Realm", Bearer realm=https://r/token,service=r`},
+			expected: []challenge{
+				{Scheme: "basic", Params: map[string]string{"realm": "Registry Realm"}},
+				{Scheme: "bearer", Params: map[string]string{"realm": "https://r/token", "service": "r"}},
+			},
+		},
+		"escaped_quote": {
+			headers:  []string{`Basic realm="say \"hi\""`},
+			expected: []challenge{{Scheme: "basic", Params: map[string]string{"realm": `say "hi"`}}},
+		},
+	}
+	for name, tc := range cases {
+		if got := parseChallenges(tc.headers); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", name, tc.expected, got)
+		}
+	}
+}
+
+// tokenRegistry is a registry with token authentication. It rate limits the
+// first manifest request and counts token requests.
+type tokenRegistry struct {
+	t             *testing.T
+	server        *httptest.Server
+	tokenRequests int
+	rateLimited   bool
+}
+
+func newTokenRegistry(t *testing.T) *tokenRegistry {
+	r := &tokenRegistry{t: t}
+	r.server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+func (r *tokenRegistry) handle(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/token":
+		r.tokenRequests++
+		switch req.Method {
+		case "GET":
+			if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "password" {
+				http.Error(w, "bad credentials", http.StatusUnauthorized)
+				return
+			}
+			if scope := req.URL.Query().Get("scope"); scope != "repository:nginx:pull" {
+				r.t.Errorf("unexpected scope %s", scope)
+			}
+		case "POST":
+			req.ParseForm()
+			if req.PostForm.Get("grant_type") != "refresh_token" || req.PostForm.Get("refresh_token") != "refresh" {
+				http.Error(w, "bad grant", http.StatusBadRequest)
+				return
+			}
+		}
+		fmt.Fprintln(w, `{"access_token": "secret-token", "expires_in": 300}`)
+		return
+	case "/nginx/manifests/1b29e1531c":
+		if !r.rateLimited {
+			r.rateLimited = true
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+	if req.Header.Get("Authorization") != "Bearer secret-token" {
+		// no scope, klar has to add repository scope itself
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer service="test",realm="%s/token"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/nginx/blobs/") {
+		fmt.Fprint(w, "blob")
+		return
+	}
+	resp, err := ioutil.ReadFile("testdata/registry-response-oci.json")
+	if err != nil {
+		r.t.Fatalf("Can't load registry test response %s", err.Error())
+	}
+	w.Write(resp)
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	for name, conf := range map[string]*Config{
+		"password":       {ImageName: "registry.domain.com/nginx:1b29e1531c", User: "user", Password: "password"},
+		"identity_token": {ImageName: "registry.domain.com/nginx:1b29e1531c", ConfigDir: "testdata/identity-token"},
+	} {
+		r := newTokenRegistry(t)
+		image, err := NewImage(conf)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		image.Registry = r.server.URL
+		if err = image.Pull(); err != nil {
+			t.Fatalf("%s: Can't pull image: %s", name, err)
+		}
+		resp, err := image.FetchBlob("sha256:abc")
+		if err != nil {
+			t.Fatalf("%s: Can't fetch blob: %s", name, err)
+		}
+		resp.Body.Close()
+		if r.tokenRequests != 1 {
+			t.Errorf("%s: expected 1 token request, got %d", name, r.tokenRequests)
+		}
+		if auth := image.Authorization(); auth != "Bearer secret-token" {
+			t.Errorf("%s: unexpected authorization %s", name, auth)
+		}
+		r.server.Close()
+	}
+}
@@ -0,0 +1,156 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubServer is the key Docker CLI uses for Docker Hub credentials
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// credentials represents registry credentials found in Docker config file
+type credentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token, it is used instead of password
+	IdentityToken string
+}
+
+// dockerConfigFile represents the part of ~/.docker/config.json klar uses
+type dockerConfigFile struct {
+	Auths       map[string]authConfig `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type authConfig struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// helperCredentials is the output of docker-credential-<name> get
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// defaultConfigDir returns DOCKER_CONFIG or ~/.docker like Docker CLI does
+func defaultConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// lookupCredentials finds credentials for the registry domain in config.json
+// located in configDir. Credential helpers take precedence over auths entries,
+// the same way as in Docker CLI. Nil is returned if there are no credentials.
+func lookupCredentials(configDir, domain string) (*credentials, error) {
+	if configDir == "" {
+		configDir = defaultConfigDir()
+	}
+	data, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read docker config: %s", err)
+	}
+	var conf dockerConfigFile
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("Can't parse docker config: %s", err)
+	}
+
+	server := credentialsServer(domain)
+	if helper, ok := conf.CredHelpers[server]; ok {
+		return helperGet(helper, server)
+	}
+	if conf.CredsStore != "" {
+		return helperGet(conf.CredsStore, server)
+	}
+	for key, auth := range conf.Auths {
+		if credentialsServer(key) == server {
+			return auth.credentials()
+		}
+	}
+	return nil, nil
+}
+
+// credentialsServer converts registry domain or a config key which may be
+// a URL into the server name Docker CLI uses as a key
+func credentialsServer(s string) string {
+	host := s
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i != -1 {
+		host = host[:i]
+	}
+	switch host {
+	case dockerHubDomain, dockerHubLegacy, dockerHub:
+		return dockerHubServer
+	}
+	return host
+}
+
+func (a authConfig) credentials() (*credentials, error) {
+	c := &credentials{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+	}
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode auth in docker config: %s", err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid auth in docker config")
+		}
+		c.Username, c.Password = parts[0], parts[1]
+	}
+	if c.Username == "" && c.IdentityToken == "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// helperGet runs docker-credential-<helper> get with server on stdin
+func helperGet(helper, server string) (*credentials, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		// helpers report missing credentials with a non-zero exit code
+		if strings.Contains(out, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Credential helper %s failed: %s %s", helper, err, out)
+	}
+	var hc helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &hc); err != nil {
+		return nil, fmt.Errorf("Can't parse credential helper %s output: %s", helper, err)
+	}
+	if hc.Username == "<token>" {
+		return &credentials{IdentityToken: hc.Secret}, nil
+	}
+	return &credentials{Username: hc.Username, Password: hc.Secret}, nil
+}
@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDockerConfig = `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1YnNlY3JldA=="},
+		"172.31.29.60:5000": {"auth": "amVua2luczpzZWNyZXQ="},
+		"https://quay.io": {"identitytoken": "refresh-token"}
+	},
+	"credHelpers": {
+		"123456789.dkr.ecr.eu-west-1.amazonaws.com": "fake"
+	}
+}`
+
+// fakeHelper is a docker-credential-fake script which knows one registry
+const fakeHelper = `#!/bin/sh
+read server
+if [ "$server" = "123456789.dkr.ecr.eu-west-1.amazonaws.com" ]; then
+	echo '{"ServerURL": "'$server'", "Username": "AWS", "Secret": "ecr-password"}'
+	exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatalf("Can't write %s: %s", path, err)
+	}
+}
+
+func TestLookupCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-docker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "config.json"), testDockerConfig, 0600)
+	writeFile(t, filepath.Join(dir, "docker-credential-fake"), fakeHelper, 0700)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cases := map[string]struct {
+		domain   string
+		expected *credentials
+	}{
+		"hub": {
+			domain:   "docker.io",
+			expected: &credentials{Username: "hub", Password: "hubsecret"},
+		},
+		"registry_port": {
+			domain:   "172.31.29.60:5000",
+			expected: &credentials{Username: "jenkins", Password: "secret"},
+		},
+		"identity_token": {
+			domain:   "quay.io",
+			expected: &credentials{IdentityToken: "refresh-token"},
+		},
+		"cred_helper": {
+			domain:   "123456789.dkr.ecr.eu-west-1.amazonaws.com",
+			expected: &credentials{Username: "AWS", Password: "ecr-password"},
+		},
+		"unknown": {
+			domain: "gcr.io",
+		},
+	}
+	for name, tc := range cases {
+		creds, err := lookupCredentials(dir, tc.domain)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if (creds == nil) != (tc.expected == nil) || (creds != nil && *creds != *tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", name, tc.expected, creds)
+		}
+	}
+
+	// credsStore is used for every registry without a credHelpers entry
+	writeFile(t, filepath.Join(dir, "config.json"), `{"credsStore": "fake"}`, 0600)
+	creds, err := lookupCredentials(dir, "gcr.io")
+	if err != nil || creds != nil {
+		t.Errorf("expected no credentials, got %+v, %v", creds, err)
+	}
+	writeFile(t, filepath.Join(dir, "config.json"), `{"credsStore": "missing"}`, 0600)
+	if _, err := lookupCredentials(dir, "gcr.io"); err == nil {
+		t.Error("expected an error for a missing credential helper")
+	}
+
+	os.Remove(filepath.Join(dir, "config.json"))
+	creds, err = lookupCredentials(dir, "docker.io")
+	if err != nil || creds != nil {
+		t.Errorf("expected no credentials without config file, got %+v, %v", creds, err)
+	}
+}
+
+func TestNewImageCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-docker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "config.json"), testDockerConfig, 0600)
+
+	image, err := NewImage(&Config{ImageName: "172.31.29.60:5000/flask-lab-training", ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.auth.basic != "Basic amVua2luczpzZWNyZXQ=" {
+		t.Errorf("expected credentials from config file, got %s", image.auth.basic)
+	}
+
+	// explicit credentials take precedence
+	image, err = NewImage(&Config{ImageName: "172.31.29.60:5000/flask-lab-training", ConfigDir: dir, User: "user", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.auth.user != "user" || image.auth.basic != "Basic dXNlcjpwYXNzd29yZA==" {
+		t.Errorf("expected explicit credentials, got %s", image.auth.basic)
+	}
+}
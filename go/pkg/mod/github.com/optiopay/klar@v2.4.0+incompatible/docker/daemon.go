@@ -0,0 +1,108 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/optiopay/klar/utils"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerDaemon is an image in the local Docker Engine. The image is
+// exported with /images/{name}/get into a temporary docker save archive.
+type dockerDaemon struct {
+	host    string
+	name    string
+	timeout time.Duration
+	archive *dockerArchive
+}
+
+// daemonClient returns HTTP client and base URL for Docker Engine API
+// at host in DOCKER_HOST format: unix:///path or tcp://host:port.
+// The timeout limits connecting only, exporting a big image takes long.
+func daemonClient(host string, timeout time.Duration) (*http.Client, string, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		}, "http://docker", nil
+	case strings.HasPrefix(host, "tcp://"):
+		return &http.Client{
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		}, "http://" + strings.TrimPrefix(host, "tcp://"), nil
+	}
+	return nil, "", fmt.Errorf("Docker host %s is not supported, expected unix:// or tcp://", host)
+}
+
+func (d *dockerDaemon) load(image *Image) error {
+	client, base, err := daemonClient(d.host, d.timeout)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", base+"/images/"+url.PathEscape(d.name)+"/get", nil)
+	if err != nil {
+		return fmt.Errorf("Can't create an image export request: %s", err)
+	}
+	utils.DumpRequest(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't connect to Docker Engine: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("Docker Engine returned %d exporting %s: %s", resp.StatusCode, d.name, apiErr.Message)
+	}
+
+	f, err := ioutil.TempFile("", "klar-docker-daemon-")
+	if err != nil {
+		return fmt.Errorf("Can't create a temporary file: %s", err)
+	}
+	d.archive = &dockerArchive{path: f.Name()}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Can't export image %s: %s", d.name, err)
+	}
+	return d.archive.load(image)
+}
+
+func (d *dockerDaemon) openBlob(digest string) (io.ReadCloser, int64, error) {
+	return d.archive.openBlob(digest)
+}
+
+func (d *dockerDaemon) close() error {
+	if d.archive == nil {
+		return nil
+	}
+	err := d.archive.close()
+	os.Remove(d.archive.path)
+	return err
+}
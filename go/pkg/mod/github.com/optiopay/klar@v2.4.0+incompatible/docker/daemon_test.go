@@ -0,0 +1,114 @@
+package docker
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// engineServer serves image export of the test archive on a unix socket
+func engineServer(t *testing.T, dir string) string {
+	archive, _ := writeTestArchive(t, dir)
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// references are escaped as one path segment
+		switch r.URL.EscapedPath() {
+		case "/images/flask-lab-training:latest/get", "/images/registry:5000%2Fns%2Fimg:tag/get":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"message": "reference does not exist"}`)
+			return
+		}
+		f, err := os.Open(archive)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/x-tar")
+		io.Copy(w, f)
+	}))
+	return "unix://" + socket
+}
+
+func TestDockerDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := engineServer(t, dir)
+
+	image, err := NewImage(&Config{ImageName: "docker-daemon:flask-lab-training:latest", DockerHost: host, ServeAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !image.IsLocal() {
+		t.Fatal("Expected a local image")
+	}
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't export image: %s", err)
+	}
+	if image.Name != "library/flask-lab-training" || image.Tag != "latest" {
+		t.Errorf("Unexpected image name %s:%s", image.Name, image.Tag)
+	}
+	if len(image.FsLayers) != 2 {
+		t.Fatalf("Expected 2 fsLayers, got %d", len(image.FsLayers))
+	}
+	resp, err := http.Get(image.Registry + "/" + image.Name + "/blobs/" + image.FsLayers[0].BlobSum)
+	if err != nil {
+		t.Fatalf("Can't get layer from blob server: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected blob response %d", resp.StatusCode)
+	}
+
+	tmp := image.source.(*dockerDaemon).archive.path
+	if err := image.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Expected exported archive %s to be removed", tmp)
+	}
+
+	image, _ = NewImage(&Config{ImageName: "docker-daemon:registry:5000/ns/img:tag", DockerHost: host, ServeAddr: "127.0.0.1:0"})
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't export image with a registry reference: %s", err)
+	}
+	image.Close()
+
+	image, _ = NewImage(&Config{ImageName: "docker-daemon:other:latest", DockerHost: host})
+	if err := image.Pull(); err == nil {
+		t.Fatal("Expected an error for a missing image")
+	}
+	image.Close()
+}
+
+func TestDaemonClient(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		base string
+		err  bool
+	}{
+		{"unix:///var/run/docker.sock", "http://docker", false},
+		{"tcp://127.0.0.1:2375", "http://127.0.0.1:2375", false},
+		{"npipe:////./pipe/docker_engine", "", true},
+	} {
+		_, base, err := daemonClient(tc.host, 0)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.host, err)
+		}
+		if base != tc.base {
+			t.Errorf("%s: expected base %s, got %s", tc.host, tc.base, base)
+		}
+	}
+}
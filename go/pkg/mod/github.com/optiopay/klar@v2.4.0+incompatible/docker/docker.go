@@ -1,45 +1,65 @@
 package docker
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 	"time"
-
-	"github.com/optiopay/klar/utils"
-)
-
-const (
-	stateInitial = iota
-	stateName
-	statePort
-	stateTag
 )
 
 // Image represents Docker image
 type Image struct {
-	Registry      string
-	Name          string
-	Tag           string
-	FsLayers      []FsLayer
-	Token         string
-	user          string
-	password      string
-	client        http.Client
-	digest        string
+	Registry string
+	Name     string
+	Tag      string
+	FsLayers []FsLayer
+	Token    string
+	// Digest is the digest of the manifest the layers were taken from.
+	// For manifest lists it is the digest of the selected platform manifest.
+	// Before Pull it is the digest the image is pinned to, if any.
+	Digest        string
+	Platform      Platform
+	client        *http.Client
+	auth          *authenticator
+	scope         *bearerScope
+	configDigest  string
 	schemaVersion int
+	// source is set for images which are not pulled from a registry
+	source    imageSource
+	server    *http.Server
+	serveAddr string
+	serveURL  string
+	// proxy is set if Clair gets layers of a registry image from klar,
+	// upstream is the registry API URL then
+	proxy    bool
+	upstream string
+	// mirrors are tried before the registry, see pullReferenceManifest
+	mirrors []endpoint
 }
 
+// LayerName returns the name of the layer in Clair. It is the digest of the
+// blob digests of the layer and its parents, so images sharing parent blobs
+// share their names in Clair. Unlike the OCI chain ID it is computed from
+// compressed blobs, a layer compressed again, e.g. by a mirror, gets
+// another name and is indexed again.
 func (i *Image) LayerName(index int) string {
-	s := fmt.Sprintf("%s%s", trimDigest(i.digest),
-		trimDigest(i.FsLayers[index].BlobSum))
-	return s
+	return trimDigest(blobChain(i.FsLayers[:index+1]))
+}
+
+// blobChain returns the digest identifying the blobs applied in order,
+// the digest of the only blob if there is one
+func blobChain(layers []FsLayer) string {
+	id := layers[0].BlobSum
+	for _, l := range layers[1:] {
+		id = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(id+" "+l.BlobSum)))
+	}
+	return id
 }
 
 func (i *Image) AnalyzedLayerName() string {
@@ -57,6 +77,9 @@ func trimDigest(d string) string {
 // FsLayer represents a layer in docker image
 type FsLayer struct {
 	BlobSum string
+	// CreatedBy is the command which created the layer from the image
+	// config history, empty if unknown
+	CreatedBy string
 }
 
 // ImageV1 represents a Manifest V 2, Schema 1 Docker Image
@@ -75,9 +98,10 @@ type config struct {
 	Digest    string
 }
 
-// imageV2 represents Manifest V 2, Schema 2 Docker Image
+// imageV2 represents Manifest V 2, Schema 2 Docker Image or OCI Image Manifest
 type imageV2 struct {
 	SchemaVersion int
+	MediaType     string
 	Config        config
 	Layers        []layer
 }
@@ -94,152 +118,242 @@ type Config struct {
 	Token            string
 	InsecureTLS      bool
 	InsecureRegistry bool
-	Timeout          time.Duration
+	// Timeout limits every attempt of a registry request
+	Timeout time.Duration
+	// Retries is the number of times failed requests are repeated,
+	// utils.DefaultRetries if 0. Negative value disables retries.
+	Retries int
+	// Context bounds all registry requests, e.g. with the scan deadline.
+	// Default is no deadline.
+	Context context.Context
+	// Platform selects a manifest from a manifest list, e.g. linux/arm64.
+	// Empty value means linux/amd64.
+	Platform string
+	// ConfigDir is a directory with Docker config.json used to look up
+	// credentials if User and Token are empty. Default is DOCKER_CONFIG or ~/.docker
+	ConfigDir string
+	// ServeAddr is the listen address of the HTTP server klar runs to serve
+	// layers of local images to Clair. Default is a random port.
+	ServeAddr string
+	// ServeURL is the base URL Clair uses to reach the server.
+	// Default is http://<first non-loopback address>:<port>.
+	ServeURL string
+	// DockerHost is the Docker Engine API address for docker-daemon: images.
+	// Default is DOCKER_HOST or unix:///var/run/docker.sock.
+	DockerHost string
+	// Registries holds settings of registries by host[:port] as in image
+	// names, Docker Hub is docker.io
+	Registries map[string]RegistryConfig
+	// Proxy makes klar serve layers of registry images to Clair, so Clair
+	// doesn't need to reach the registry. ServeAddr and ServeURL apply.
+	Proxy bool
 }
 
 const dockerHub = "registry-1.docker.io"
 
-var tokenRe = regexp.MustCompile(`Bearer realm="(.*?)",service="(.*?)",scope="(.*?)"`)
-
-// NewImage parses image name which could be the ful name registry:port/name:tag
+// NewImage parses image name which could be the full name registry:port/name:tag@digest
 // or in any other shorter forms and creates docker image entity without
-// information about layers
+// information about layers. Local images are referenced as docker-archive:path.tar,
+// oci:dir or docker-daemon:name:tag.
 func NewImage(conf *Config) (*Image, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.InsecureTLS},
-		Proxy:           http.ProxyFromEnvironment,
-	}
-	client := http.Client{
-		Transport: tr,
-		Timeout:   conf.Timeout,
-	}
-	registry := dockerHub
-	tag := "latest"
-	token := ""
-	var nameParts, tagParts []string
-	var name, port string
-	state := stateInitial
-	start := 0
-	for i, c := range conf.ImageName {
-		if c == ':' || c == '/' || c == '@' || i == len(conf.ImageName)-1 {
-			if i == len(conf.ImageName)-1 {
-				// ignore a separator, include the last symbol
-				i += 1
-			}
-			part := conf.ImageName[start:i]
-			start = i + 1
-			switch state {
-			case stateInitial:
-				if part == "localhost" || strings.Contains(part, ".") {
-					// it's registry, let's check what's next =port of image name
-					registry = part
-					if c == ':' {
-						state = statePort
-					} else {
-						state = stateName
-					}
-				} else {
-					// it's an image name, if separator is /
-					// next part is also part of the name
-					// othrewise it's an offcial image
-					if c == '/' {
-						// we got just a part of name, till next time
-						start = 0
-						state = stateName
-					} else {
-						state = stateTag
-						name = fmt.Sprintf("library/%s", part)
-					}
-				}
-			case stateTag:
-				tag = ""
-				tagParts = append(tagParts, part)
-			case statePort:
-				state = stateName
-				port = part
-			case stateName:
-				if c == ':' || c == '@' {
-					state = stateTag
-				}
-				nameParts = append(nameParts, part)
-			}
+	platform := defaultPlatform
+	if conf.Platform != "" {
+		p, err := ParsePlatform(conf.Platform)
+		if err != nil {
+			return nil, err
 		}
+		platform = p
 	}
-
-	if port != "" {
-		registry = fmt.Sprintf("%s:%s", registry, port)
+	if local := newLocalImage(conf, platform); local != nil {
+		return local, nil
 	}
-	if name == "" {
-		name = strings.Join(nameParts, "/")
+
+	ref, err := ParseReference(conf.ImageName)
+	if err != nil {
+		return nil, err
 	}
-	if tag == "" {
-		tag = strings.Join(tagParts, ":")
+	client, err := conf.registryClient(ref.Domain)
+	if err != nil {
+		return nil, err
 	}
-	if conf.InsecureRegistry {
-		registry = fmt.Sprintf("http://%s/v2", registry)
-	} else {
-		registry = fmt.Sprintf("https://%s/v2", registry)
+	mirrors, err := conf.mirrorEndpoints(ref.Domain)
+	if err != nil {
+		return nil, err
 	}
+	registry := conf.registryURL(ref.Registry())
+	token := ""
 	if conf.Token != "" {
 		token = "Basic " + conf.Token
 	}
+	user, password, identityToken := conf.User, conf.Password, ""
+	if user == "" && token == "" {
+		creds, err := lookupCredentials(conf.ConfigDir, ref.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("Can't get credentials for %s: %s", ref.Domain, err)
+		}
+		if creds != nil {
+			user, password, identityToken = creds.Username, creds.Password, creds.IdentityToken
+		}
+	}
 
 	return &Image{
-		Registry: registry,
-		Name:     name,
-		Tag:      tag,
-		user:     conf.User,
-		password: conf.Password,
-		Token:    token,
-		client:   client,
+		Registry:  registry,
+		Name:      ref.Path,
+		Tag:       ref.Tag,
+		Digest:    ref.Digest,
+		Token:     token,
+		Platform:  platform,
+		client:    client,
+		auth:      newAuthenticator(client, user, password, conf.Token, identityToken),
+		mirrors:   mirrors,
+		proxy:     conf.Proxy,
+		serveAddr: conf.ServeAddr,
+		serveURL:  conf.ServeURL,
 	}, nil
 }
 
 // Pull retrieves information about layers from docker registry.
-// It gets docker registry token if needed.
+// It gets docker registry token if needed. If the tag points to a manifest
+// list or an OCI index, the manifest for the image platform is pulled.
 func (i *Image) Pull() error {
-	resp, err := i.pullReq()
+	if i.IsLocal() {
+		return i.pullLocal()
+	}
+	m, err := i.pullReferenceManifest()
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusUnauthorized {
-		if i.Token == "" {
-			i.Token, err = i.requestToken(resp)
-			io.Copy(ioutil.Discard, resp.Body)
-		}
+	if m.isIndex() {
+		d, err := m.selectPlatform(i.Platform)
 		if err != nil {
 			return err
 		}
-		// try again
-		resp, err = i.pullReq()
-		if err != nil {
+		i.Platform = d.Platform
+		if m, err = i.pullManifest(d.Digest); err != nil {
 			return err
 		}
-		defer resp.Body.Close()
-		// try one more time by clearing the token to request it
-		if resp.StatusCode == http.StatusUnauthorized {
-			i.Token, err = i.requestToken(resp)
-			io.Copy(ioutil.Discard, resp.Body)
-			if err != nil {
-				return err
-			}
-			// try again
-			resp, err = i.pullReq()
-			if err != nil {
-				return err
+		if m.isIndex() {
+			return fmt.Errorf("Manifest %s for platform %s is a manifest list", d.Digest, d.Platform)
+		}
+	}
+	if err := parseManifest(m, i); err != nil {
+		return err
+	}
+	i.loadHistory()
+	if i.proxy {
+		return i.proxyBlobs(i)
+	}
+	return nil
+}
+
+// loadHistory fetches layer history, images are analyzed without it
+// if it isn't available
+func (i *Image) loadHistory() {
+	if err := i.fetchHistory(); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't get history of %s: %s\n", i.Name, err)
+	}
+}
+
+// PullPlatforms retrieves information about layers for every platform of
+// a manifest list or an OCI index, one image per platform. If the tag points
+// to a single manifest the image itself is returned.
+func (i *Image) PullPlatforms() ([]*Image, error) {
+	if i.IsLocal() {
+		if err := i.pullLocal(); err != nil {
+			return nil, err
+		}
+		return []*Image{i}, nil
+	}
+	m, err := i.pullReferenceManifest()
+	if err != nil {
+		return nil, err
+	}
+	if !m.isIndex() {
+		if err := parseManifest(m, i); err != nil {
+			return nil, err
+		}
+		i.loadHistory()
+		if i.proxy {
+			if err := i.proxyBlobs(i); err != nil {
+				return nil, err
 			}
-			defer resp.Body.Close()
 		}
+		return []*Image{i}, nil
+	}
+	list, err := m.list()
+	if err != nil {
+		return nil, err
 	}
-	return parseImageResponse(resp, i)
+	var images []*Image
+	for _, d := range list.Manifests {
+		// attestation manifests are stored with unknown/unknown platform
+		if d.Platform.OS == "" || d.Platform.OS == "unknown" {
+			continue
+		}
+		image := *i
+		image.Platform = d.Platform
+		pm, err := image.pullManifest(d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if pm.isIndex() {
+			return nil, fmt.Errorf("Manifest %s for platform %s is a manifest list", d.Digest, d.Platform)
+		}
+		if err := parseManifest(pm, &image); err != nil {
+			return nil, err
+		}
+		image.loadHistory()
+		images = append(images, &image)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("Manifest list %s has no platform manifests", m.digest)
+	}
+	if i.proxy {
+		if err := i.proxyBlobs(images...); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// reference returns the digest for pinned images and the tag otherwise
+func (i *Image) reference() string {
+	if i.Digest != "" {
+		return i.Digest
+	}
+	return i.Tag
+}
+
+// pullManifest requests the manifest by tag or digest and reads it.
+// Manifests requested by digest are verified against it.
+func (i *Image) pullManifest(reference string) (*manifest, error) {
+	resp, err := i.pullReq(reference)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("Manifest request returned %d", resp.StatusCode)
+	}
+	m, err := readManifest(resp)
+	if err != nil {
+		return nil, err
+	}
+	if isDigest(reference) {
+		if err := m.verify(reference); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
-func parseImageResponse(resp *http.Response, image *Image) error {
-	contentType := resp.Header.Get("Content-Type")
-	if contentType == "application/vnd.docker.distribution.manifest.v2+json" {
+func parseManifest(m *manifest, image *Image) error {
+	image.Digest = m.digest
+	switch m.mediaType {
+	case mediaTypeManifestV2, mediaTypeOCIManifest:
 		var imageV2 imageV2
-		if err := json.NewDecoder(resp.Body).Decode(&imageV2); err != nil {
+		if err := json.Unmarshal(m.body, &imageV2); err != nil {
 			fmt.Fprintln(os.Stderr, "Image V2 decode error")
 			return err
 		}
@@ -247,11 +361,11 @@ func parseImageResponse(resp *http.Response, image *Image) error {
 		for i := range imageV2.Layers {
 			image.FsLayers[i].BlobSum = imageV2.Layers[i].Digest
 		}
-		image.digest = imageV2.Config.Digest
+		image.configDigest = imageV2.Config.Digest
 		image.schemaVersion = imageV2.SchemaVersion
-	} else {
+	default:
 		var imageV1 imageV1
-		if err := json.NewDecoder(resp.Body).Decode(&imageV1); err != nil {
+		if err := json.Unmarshal(m.body, &imageV1); err != nil {
 			fmt.Fprintln(os.Stderr, "ImageV1 decode error")
 			return err
 		}
@@ -266,76 +380,93 @@ func parseImageResponse(resp *http.Response, image *Image) error {
 	return nil
 }
 
-func (i *Image) requestToken(resp *http.Response) (string, error) {
-	authHeader := resp.Header.Get("Www-Authenticate")
-	if authHeader == "" {
-		return "", fmt.Errorf("Empty Www-Authenticate")
-	}
-	parts := tokenRe.FindStringSubmatch(authHeader)
-	if parts == nil {
-		return "", fmt.Errorf("Can't parse Www-Authenticate: %s", authHeader)
-	}
-	realm, service, scope := parts[1], parts[2], parts[3]
-	var url string
-	if i.user != "" {
-		url = fmt.Sprintf("%s?service=%s&scope=%s&account=%s", realm, service, scope, i.user)
-	} else {
-		url = fmt.Sprintf("%s?service=%s&scope=%s", realm, service, scope)
-	}
-	req, err := http.NewRequest("GET", url, nil)
+func (i *Image) pullReq(reference string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s/manifests/%s", i.registryURL(), i.Name, reference)
+	return i.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Prefer manifest schema v2 and OCI manifests, fall back to schema v1
+		req.Header.Set("Accept", manifestAccept)
+		return req, nil
+	})
+}
+
+// FetchBlob requests a blob, e.g. a layer, from the registry. The caller
+// must close the response body.
+func (i *Image) FetchBlob(digest string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s/blobs/%s", i.registryURL(), i.Name, digest)
+	resp, err := i.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", url, nil)
+	})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Can't create a request")
-		return "", err
-	}
-	if i.user != "" {
-		req.SetBasicAuth(i.user, i.password)
+		return nil, err
 	}
-	tResp, err := i.client.Do(req)
-	if err != nil {
-		io.Copy(ioutil.Discard, tResp.Body)
-		return "", err
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Blob request %s returned %d", digest, resp.StatusCode)
 	}
+	return resp, nil
+}
 
-	defer tResp.Body.Close()
-	if tResp.StatusCode != http.StatusOK {
-		io.Copy(ioutil.Discard, tResp.Body)
-		return "", fmt.Errorf("Token request returned %d", tResp.StatusCode)
+// do sends a registry request built by newReq. If the registry responds
+// with 401 it gets a token for the challenge and repeats the request,
+// a cached token rejected by the registry is requested again once.
+func (i *Image) do(newReq func() (*http.Request, error)) (*http.Response, error) {
+	resp, err := i.send(newReq)
+	for attempt := 0; err == nil && i.auth != nil && resp.StatusCode == http.StatusUnauthorized && attempt < 2; attempt++ {
+		challenges := parseChallenges(resp.Header["Www-Authenticate"])
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		token, scope, err := i.auth.authorize(challenges, i.Name, attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		i.Token, i.scope = token, scope
+		resp, err = i.send(newReq)
 	}
-	var tokenEnv struct {
-		Token string
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get error")
+		return nil, err
 	}
+	return resp, nil
+}
 
-	if err = json.NewDecoder(tResp.Body).Decode(&tokenEnv); err != nil {
-		fmt.Fprintln(os.Stderr, "Token response decode error")
-		return "", err
-	}
-	return fmt.Sprintf("Bearer %s", tokenEnv.Token), nil
+func (i *Image) send(newReq func() (*http.Request, error)) (*http.Response, error) {
+	return checkRateLimited(i.client, func() (*http.Request, error) {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		if i.Token == "" && i.auth != nil && i.auth.basic != "" {
+			// credentials are sent right away, registries without
+			// token authentication won't ask for them
+			i.Token = i.auth.basic
+		}
+		if i.Token != "" {
+			req.Header.Set("Authorization", i.Token)
+		}
+		return req, nil
+	})
 }
 
-func (i *Image) pullReq() (*http.Response, error) {
-	url := fmt.Sprintf("%s/%s/manifests/%s", i.Registry, i.Name, i.Tag)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Can't create a request")
-		return nil, err
+// Authorization returns Authorization header value for registry requests
+// made on behalf of klar, e.g. by Clair fetching layers. An expired bearer
+// token is renewed. It is empty if layers are proxied, credentials stay with klar.
+func (i *Image) Authorization() string {
+	if i.upstream != "" {
+		return ""
 	}
-	if i.Token == "" {
-		if i.user != "" {
-			req.SetBasicAuth(i.user, i.password)
-			i.Token = req.Header.Get("Authorization")
-		}
-	} else {
-		req.Header.Set("Authorization", i.Token)
+	if i.auth == nil || i.scope == nil {
+		return i.Token
 	}
-
-	// Prefer manifest schema v2
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.v1+prettyjws")
-	utils.DumpRequest(req)
-	resp, err := i.client.Do(req)
+	token, err := i.auth.bearer(*i.scope, false)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Get error")
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Can't renew registry token: %s\n", err)
+		return i.Token
 	}
-	utils.DumpResponse(resp)
-	return resp, nil
+	i.Token = token
+	return token
 }
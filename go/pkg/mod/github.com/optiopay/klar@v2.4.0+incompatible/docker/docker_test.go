@@ -1,10 +1,12 @@
 package docker
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -14,6 +16,7 @@ func TestNewImage(t *testing.T) {
 		registry string
 		name     string
 		tag      string
+		digest   string
 	}{
 		"full": {
 			image:    "docker-registry.domain.com:8080/nginx:1b29e1531c",
@@ -62,7 +65,20 @@ func TestNewImage(t *testing.T) {
 			image:    "postgres@sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
 			registry: "https://registry-1.docker.io/v2",
 			name:     "library/postgres",
-			tag:      "sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
+			digest:   "sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
+		},
+		"digest_with_port": {
+			image:    "registry:5000/team/app@sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
+			registry: "https://registry:5000/v2",
+			name:     "team/app",
+			digest:   "sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
+		},
+		"tag_and_digest": {
+			image:    "app:1.0@sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
+			registry: "https://registry-1.docker.io/v2",
+			name:     "library/app",
+			tag:      "1.0",
+			digest:   "sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999",
 		},
 		"localhost_no_tag": {
 			image:    "localhost/nginx",
@@ -92,6 +108,9 @@ func TestNewImage(t *testing.T) {
 		if image.Tag != tc.tag {
 			t.Fatalf("%s: Expected image tag %s, got %s", name, tc.tag, image.Tag)
 		}
+		if image.Digest != tc.digest {
+			t.Fatalf("%s: Expected image digest %s, got %s", name, tc.digest, image.Digest)
+		}
 	}
 
 }
@@ -138,3 +157,181 @@ func TestPullManifestSchemaV2(t *testing.T) {
 		t.Fatal("Can't pull fsLayers")
 	}
 }
+
+func TestPullManifestOCI(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := ioutil.ReadFile("testdata/registry-response-oci.json")
+		if err != nil {
+			t.Fatalf("Can't load registry test response %s", err.Error())
+		}
+		// some registries don't set a proper content type
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, string(resp))
+	}))
+	defer ts.Close()
+
+	image, err := NewImage(&Config{ImageName: "docker-registry.domain.com/nginx:1b29e1531c"})
+	image.Registry = ts.URL
+	err = image.Pull()
+	if err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	if len(image.FsLayers) != 2 {
+		t.Fatalf("Expected 2 fsLayers, got %d", len(image.FsLayers))
+	}
+}
+
+const (
+	amdDigest = "sha256:3425d8de16dc5e5f88eff6b91001b18b64d980b12a2d66c10922327be384c8a5"
+	armDigest = "sha256:9681f838d42ad284c03c8348f78fe79219e2634c578938caf5ec484c99bdba14"
+)
+
+// manifestListServer serves manifest list for tag 1b29e1531c and platform manifests by digest
+func manifestListServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") && !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			t.Errorf("Accept header does not include OCI index: %s", r.Header.Get("Accept"))
+		}
+		var file string
+		switch r.URL.Path {
+		case "/nginx/manifests/1b29e1531c":
+			file = "testdata/registry-response-manifest-list.json"
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+		case "/nginx/manifests/" + amdDigest:
+			file = "testdata/registry-response-schemav2.json"
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		case "/nginx/manifests/" + armDigest:
+			file = "testdata/registry-response-oci.json"
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		resp, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Can't load registry test response %s", err.Error())
+		}
+		w.Write(resp)
+	}))
+}
+
+func TestPullManifestList(t *testing.T) {
+	ts := manifestListServer(t)
+	defer ts.Close()
+
+	image, err := NewImage(&Config{ImageName: "docker-registry.domain.com/nginx:1b29e1531c", Platform: "linux/arm64"})
+	if err != nil {
+		t.Fatalf("Can't parse image name: %s", err)
+	}
+	image.Registry = ts.URL
+	if err = image.Pull(); err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	if image.Digest != armDigest {
+		t.Fatalf("Expected digest %s, got %s", armDigest, image.Digest)
+	}
+	if image.Platform.Variant != "v8" {
+		t.Fatalf("Expected resolved platform variant v8, got %s", image.Platform)
+	}
+	if len(image.FsLayers) != 2 {
+		t.Fatalf("Expected 2 fsLayers, got %d", len(image.FsLayers))
+	}
+
+	image, _ = NewImage(&Config{ImageName: "docker-registry.domain.com/nginx:1b29e1531c", Platform: "windows/amd64"})
+	image.Registry = ts.URL
+	if err = image.Pull(); err == nil {
+		t.Fatal("Expected an error for a missing platform")
+	}
+}
+
+func TestPullPlatforms(t *testing.T) {
+	ts := manifestListServer(t)
+	defer ts.Close()
+
+	image, err := NewImage(&Config{ImageName: "docker-registry.domain.com/nginx:1b29e1531c"})
+	image.Registry = ts.URL
+	images, err := image.PullPlatforms()
+	if err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("Expected 2 platform images, got %d", len(images))
+	}
+	expected := []struct {
+		platform string
+		digest   string
+		layers   int
+	}{
+		{"linux/amd64", amdDigest, 16},
+		{"linux/arm64/v8", armDigest, 2},
+	}
+	for i, image := range images {
+		if image.Platform.String() != expected[i].platform {
+			t.Errorf("Expected platform %s, got %s", expected[i].platform, image.Platform)
+		}
+		if image.Digest != expected[i].digest {
+			t.Errorf("%s: expected digest %s, got %s", image.Platform, expected[i].digest, image.Digest)
+		}
+		if len(image.FsLayers) != expected[i].layers {
+			t.Errorf("%s: expected %d fsLayers, got %d", image.Platform, expected[i].layers, len(image.FsLayers))
+		}
+	}
+}
+
+func TestPullByDigest(t *testing.T) {
+	ts := manifestListServer(t)
+	defer ts.Close()
+
+	image, err := NewImage(&Config{ImageName: "docker-registry.domain.com:5000/nginx:ignored@" + armDigest})
+	if err != nil {
+		t.Fatalf("Can't parse image name: %s", err)
+	}
+	image.Registry = ts.URL
+	if err = image.Pull(); err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	if len(image.FsLayers) != 2 {
+		t.Fatalf("Expected 2 fsLayers, got %d", len(image.FsLayers))
+	}
+
+	// the registry returns a different manifest than requested
+	tampered := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := ioutil.ReadFile("testdata/registry-response-oci.json")
+		if err != nil {
+			t.Fatalf("Can't load registry test response %s", err.Error())
+		}
+		w.Write(resp)
+	}))
+	defer tampered.Close()
+	image, _ = NewImage(&Config{ImageName: "docker-registry.domain.com:5000/nginx@" + amdDigest})
+	image.Registry = tampered.URL
+	if err = image.Pull(); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("Expected digest mismatch error, got %v", err)
+	}
+}
+
+func TestLayerName(t *testing.T) {
+	base := []FsLayer{{BlobSum: "sha256:aaa"}, {BlobSum: "sha256:bbb"}}
+	app := &Image{configDigest: "sha256:app", FsLayers: append(append([]FsLayer{}, base...), FsLayer{BlobSum: "sha256:ccc"})}
+	other := &Image{configDigest: "sha256:other", FsLayers: append(append([]FsLayer{}, base...), FsLayer{BlobSum: "sha256:ddd"})}
+
+	if name := app.LayerName(0); name != "aaa" {
+		t.Errorf("Expected the base layer named by its digest, got %s", name)
+	}
+	if name := app.LayerName(1); name != fmt.Sprintf("%x", sha256.Sum256([]byte("sha256:aaa sha256:bbb"))) {
+		t.Errorf("Unexpected chain name %s", name)
+	}
+	for i := range base {
+		if app.LayerName(i) != other.LayerName(i) {
+			t.Errorf("Expected layer %d shared by images with the same parents", i)
+		}
+	}
+	if app.LayerName(2) == other.LayerName(2) {
+		t.Error("Expected different names of different layers")
+	}
+	// the same blob on another parent is another layer
+	reordered := &Image{FsLayers: []FsLayer{{BlobSum: "sha256:bbb"}, {BlobSum: "sha256:aaa"}}}
+	if reordered.LayerName(1) == app.LayerName(1) {
+		t.Error("Expected names to depend on the parent chain")
+	}
+}
@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// maxConfigSize limits the image config read from a registry
+const maxConfigSize = 8 << 20
+
+// historyEntry is an entry of the image config history, entries of
+// instructions which didn't create a layer, e.g. ENV, are empty layers
+type historyEntry struct {
+	CreatedBy  string `json:"created_by"`
+	EmptyLayer bool   `json:"empty_layer"`
+}
+
+// Instruction returns the Dockerfile instruction which created the layer,
+// e.g. RUN apt-get install -y curl. It is empty if the image config has no
+// history for the layer.
+func (l FsLayer) Instruction() string {
+	s := strings.TrimSpace(l.CreatedBy)
+	s = strings.TrimSpace(strings.TrimSuffix(s, "# buildkit"))
+	const shell = "/bin/sh -c "
+	if i := strings.Index(s, shell); i != -1 {
+		cmd := strings.TrimSpace(s[i+len(shell):])
+		// instructions other than RUN are recorded as no-op shell commands
+		if strings.HasPrefix(cmd, "#(nop)") {
+			return strings.TrimSpace(strings.TrimPrefix(cmd, "#(nop)"))
+		}
+		return "RUN " + cmd
+	}
+	return s
+}
+
+// setHistory sets CreatedBy of layers from the image config. History is
+// ignored if its entries don't match the layers.
+func (i *Image) setHistory(configData []byte) error {
+	var config imageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("Can't decode image config: %s", err)
+	}
+	var history []historyEntry
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+	if len(history) != len(i.FsLayers) {
+		return fmt.Errorf("Image config has history of %d layers, the manifest has %d", len(history), len(i.FsLayers))
+	}
+	for n := range i.FsLayers {
+		i.FsLayers[n].CreatedBy = history[n].CreatedBy
+	}
+	return nil
+}
+
+// fetchHistory downloads the image config from the registry and sets
+// CreatedBy of layers. Schema 1 manifests have no config.
+func (i *Image) fetchHistory() error {
+	if i.configDigest == "" {
+		return nil
+	}
+	resp, err := i.FetchBlob(i.configDigest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigSize))
+	if err != nil {
+		return fmt.Errorf("Can't read image config: %s", err)
+	}
+	if err := verifyDigest(i.configDigest, data); err != nil {
+		return err
+	}
+	return i.setHistory(data)
+}
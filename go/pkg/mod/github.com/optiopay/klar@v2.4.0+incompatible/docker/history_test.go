@@ -0,0 +1,85 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLayerInstruction(t *testing.T) {
+	tests := []struct {
+		createdBy   string
+		instruction string
+	}{
+		{"", ""},
+		{"/bin/sh -c #(nop) ADD file:a0ec2d3cbe5e33b3d6ab1d5b0bd4b9b1d3e0f6d8bbd4c4d4f7a8e4d0f4e1e0ea in / ", "ADD file:a0ec2d3cbe5e33b3d6ab1d5b0bd4b9b1d3e0f6d8bbd4c4d4f7a8e4d0f4e1e0ea in /"},
+		{"/bin/sh -c #(nop)  CMD [\"nginx\" \"-g\" \"daemon off;\"]", "CMD [\"nginx\" \"-g\" \"daemon off;\"]"},
+		{"/bin/sh -c apt-get update && apt-get install -y curl", "RUN apt-get update && apt-get install -y curl"},
+		{"|1 VERSION=1.2 /bin/sh -c pip install app==$VERSION", "RUN pip install app==$VERSION"},
+		{"RUN /bin/sh -c pip install -r requirements.txt # buildkit", "RUN pip install -r requirements.txt"},
+		{"COPY . /app # buildkit", "COPY . /app"},
+	}
+	for _, tc := range tests {
+		if instruction := (FsLayer{CreatedBy: tc.createdBy}).Instruction(); instruction != tc.instruction {
+			t.Errorf("%q: expected %q, got %q", tc.createdBy, tc.instruction, instruction)
+		}
+	}
+}
+
+func TestSetHistory(t *testing.T) {
+	image := &Image{FsLayers: []FsLayer{{BlobSum: "sha256:aaa"}, {BlobSum: "sha256:bbb"}}}
+	config := `{"history": [
+		{"created_by": "/bin/sh -c #(nop) ADD file:123 in / "},
+		{"created_by": "/bin/sh -c #(nop)  ENV LANG=C.UTF-8", "empty_layer": true},
+		{"created_by": "/bin/sh -c apt-get install -y openssl"},
+		{"created_by": "/bin/sh -c #(nop)  CMD [\"bash\"]", "empty_layer": true}
+	]}`
+	if err := image.setHistory([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	if instruction := image.FsLayers[1].Instruction(); instruction != "RUN apt-get install -y openssl" {
+		t.Errorf("Unexpected instruction of the second layer %q", instruction)
+	}
+
+	image = &Image{FsLayers: []FsLayer{{BlobSum: "sha256:aaa"}}}
+	if err := image.setHistory([]byte(config)); err == nil {
+		t.Error("Expected an error if history doesn't match layers")
+	}
+	if image.FsLayers[0].CreatedBy != "" {
+		t.Errorf("Expected no history, got %q", image.FsLayers[0].CreatedBy)
+	}
+}
+
+func TestFetchHistory(t *testing.T) {
+	config := []byte(`{"history": [{"created_by": "/bin/sh -c #(nop) COPY dir:abc in /app "}]}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/blobs/"+digest {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(config)
+	}))
+	defer ts.Close()
+
+	image := &Image{
+		Registry:     ts.URL,
+		Name:         "app",
+		FsLayers:     []FsLayer{{BlobSum: "sha256:aaa"}},
+		configDigest: digest,
+		client:       http.DefaultClient,
+	}
+	if err := image.fetchHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if instruction := image.FsLayers[0].Instruction(); instruction != "COPY dir:abc in /app" {
+		t.Errorf("Unexpected instruction %q", instruction)
+	}
+
+	image.configDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if err := image.fetchHistory(); err == nil {
+		t.Error("Expected an error for a missing config")
+	}
+}
@@ -0,0 +1,200 @@
+package docker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	dockerArchivePrefix = "docker-archive:"
+	dockerDaemonPrefix  = "docker-daemon:"
+	ociLayoutPrefix     = "oci:"
+	localImageName      = "local"
+)
+
+// imageSource provides manifest and blobs of an image which is not pulled
+// from a registry. Blobs are served to Clair by klar itself.
+type imageSource interface {
+	// load fills image layers
+	load(image *Image) error
+	// openBlob opens a blob by digest, size is -1 if unknown
+	openBlob(digest string) (io.ReadCloser, int64, error)
+	close() error
+}
+
+// IsLocal reports whether the image is read from a local source
+// like an archive instead of a registry
+func (i *Image) IsLocal() bool {
+	return i.source != nil
+}
+
+// newLocalImage creates an image for docker-archive:path[:reference],
+// oci:dir[:reference] and docker-daemon:name names, nil is returned for
+// registry images
+func newLocalImage(conf *Config, platform Platform) *Image {
+	var src imageSource
+	var tag string
+	switch {
+	case strings.HasPrefix(conf.ImageName, dockerArchivePrefix):
+		path, reference := splitLocalReference(strings.TrimPrefix(conf.ImageName, dockerArchivePrefix))
+		src = &dockerArchive{path: path, reference: reference}
+	case strings.HasPrefix(conf.ImageName, dockerDaemonPrefix):
+		name := strings.TrimPrefix(conf.ImageName, dockerDaemonPrefix)
+		src = &dockerDaemon{host: conf.DockerHost, name: name, timeout: conf.Timeout}
+	case strings.HasPrefix(conf.ImageName, ociLayoutPrefix):
+		path, reference := splitLocalReference(strings.TrimPrefix(conf.ImageName, ociLayoutPrefix))
+		src = &ociLayout{dir: path, reference: reference}
+		tag = reference
+	default:
+		return nil
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	return &Image{
+		Name:      localImageName,
+		Tag:       tag,
+		Platform:  platform,
+		source:    src,
+		serveAddr: conf.ServeAddr,
+		serveURL:  conf.ServeURL,
+	}
+}
+
+// splitLocalReference splits path[:reference], paths with colons are not supported
+func splitLocalReference(s string) (string, string) {
+	if i := strings.Index(s, ":"); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// pullLocal loads the image from its source and starts serving
+// its blobs over HTTP, so Clair can download layers from klar
+func (i *Image) pullLocal() error {
+	if err := i.source.load(i); err != nil {
+		return err
+	}
+	return i.serveBlobs(i.source.openBlob)
+}
+
+// serveBlobs starts an HTTP server for Clair on ServeAddr and points
+// Registry to it. Layer paths sent to Clair don't change their form:
+// <Registry>/<Name>/blobs/<digest>. Registry has a random token of the
+// scan in the path, the server doesn't serve blobs without it.
+func (i *Image) serveBlobs(open blobHandler) error {
+	token, err := serveToken()
+	if err != nil {
+		return fmt.Errorf("Can't start blob server: %s", err)
+	}
+	addr := i.serveAddr
+	if addr == "" {
+		addr = ":0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Can't start blob server: %s", err)
+	}
+	i.server = &http.Server{Handler: tokenHandler{token: token, next: open}}
+	go i.server.Serve(listener)
+
+	base := strings.TrimSuffix(i.serveURL, "/")
+	if base == "" {
+		base = "http://" + advertisedAddr(listener.Addr().(*net.TCPAddr))
+	}
+	i.Registry = base + "/" + token + "/v2"
+	return nil
+}
+
+// serveToken returns a random path segment which only Clair learns
+func serveToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// tokenHandler serves requests whose path starts with the token
+type tokenHandler struct {
+	token string
+	next  http.Handler
+}
+
+func (h tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(h.token)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// Close stops the blob server and releases the image source
+func (i *Image) Close() error {
+	if i.server != nil {
+		i.server.Close()
+	}
+	if i.source != nil {
+		return i.source.close()
+	}
+	return nil
+}
+
+// advertisedAddr returns address of the blob server reachable from other
+// hosts. Clair usually runs in a container, so loopback address is used
+// only if there is no other.
+func advertisedAddr(addr *net.TCPAddr) string {
+	port := strconv.Itoa(addr.Port)
+	if !addr.IP.IsUnspecified() {
+		return net.JoinHostPort(addr.IP.String(), port)
+	}
+	host := "127.0.0.1"
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				host = ipNet.IP.String()
+				break
+			}
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// blobHandler serves blobs at .../blobs/<digest> paths
+type blobHandler func(digest string) (io.ReadCloser, int64, error)
+
+func (h blobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := strings.LastIndex(r.URL.Path, "/blobs/")
+	if i == -1 || (r.Method != "GET" && r.Method != "HEAD") {
+		http.NotFound(w, r)
+		return
+	}
+	digest := r.URL.Path[i+len("/blobs/"):]
+	if !isDigest(digest) {
+		http.NotFound(w, r)
+		return
+	}
+	blob, size, err := h(digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	io.Copy(w, blob)
+}
@@ -0,0 +1,182 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	mediaTypeManifestV1       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeSignedManifestV1 = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	mediaTypeManifestV2       = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest      = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex         = "application/vnd.oci.image.index.v1+json"
+)
+
+var manifestAccept = strings.Join([]string{
+	mediaTypeManifestV2,
+	mediaTypeManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+	mediaTypeSignedManifestV1,
+	mediaTypeManifestV1,
+}, ", ")
+
+// Platform describes the operating system and CPU architecture an image
+// manifest was built for
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+var defaultPlatform = Platform{OS: "linux", Architecture: "amd64"}
+
+// ParsePlatform parses platform in the form os/arch[/variant], e.g. linux/arm64/v8
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("Platform %s is not supported, expected os/arch[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// matches reports whether platform p satisfies the requested platform.
+// Variant is compared only if it was requested.
+func (p Platform) matches(requested Platform) bool {
+	if p.OS != requested.OS || p.Architecture != requested.Architecture {
+		return false
+	}
+	return requested.Variant == "" || p.Variant == requested.Variant
+}
+
+// manifestDescriptor is an entry of a Docker manifest list or an OCI index
+type manifestDescriptor struct {
+	MediaType string
+	Digest    string
+	Size      int64
+	Platform  Platform
+}
+
+// manifestList represents Docker Manifest List or OCI Image Index
+type manifestList struct {
+	SchemaVersion int
+	MediaType     string
+	Manifests     []manifestDescriptor
+}
+
+// manifest is a raw manifest as returned by the registry
+type manifest struct {
+	mediaType string
+	digest    string
+	body      []byte
+}
+
+func readManifest(resp *http.Response) (*manifest, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read manifest: %s", err)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return &manifest{
+		mediaType: detectMediaType(resp.Header.Get("Content-Type"), body),
+		digest:    digest,
+		body:      body,
+	}, nil
+}
+
+// detectMediaType trusts Content-Type if it is a known manifest type.
+// Some registries answer with a generic type, then mediaType field
+// or the shape of the document is used.
+func detectMediaType(contentType string, body []byte) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mt {
+		case mediaTypeManifestV2, mediaTypeManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex,
+			mediaTypeManifestV1, mediaTypeSignedManifestV1:
+			return mt
+		}
+	}
+	var probe struct {
+		SchemaVersion int
+		MediaType     string
+		Manifests     []json.RawMessage
+		Layers        []json.RawMessage
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return ""
+	}
+	switch {
+	case probe.MediaType != "":
+		return probe.MediaType
+	case probe.SchemaVersion == 1:
+		return mediaTypeSignedManifestV1
+	case probe.Manifests != nil:
+		return mediaTypeOCIIndex
+	case probe.Layers != nil:
+		return mediaTypeOCIManifest
+	}
+	return ""
+}
+
+// verify checks that manifest content matches the digest it was requested by.
+// Registries compute digest of signed schema 1 manifests without signatures,
+// for them Docker-Content-Digest header is trusted.
+func (m *manifest) verify(digest string) error {
+	if err := verifyDigest(digest, m.body); err != nil {
+		if m.mediaType != mediaTypeSignedManifestV1 || m.digest != digest {
+			return err
+		}
+	}
+	m.digest = digest
+	return nil
+}
+
+func (m *manifest) isIndex() bool {
+	return m.mediaType == mediaTypeManifestList || m.mediaType == mediaTypeOCIIndex
+}
+
+func (m *manifest) list() (*manifestList, error) {
+	var list manifestList
+	if err := json.Unmarshal(m.body, &list); err != nil {
+		return nil, fmt.Errorf("Can't decode manifest list: %s", err)
+	}
+	return &list, nil
+}
+
+// selectPlatform finds the manifest for the platform in a manifest list
+func (m *manifest) selectPlatform(platform Platform) (*manifestDescriptor, error) {
+	list, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Manifests {
+		if list.Manifests[i].Platform.matches(platform) {
+			return &list.Manifests[i], nil
+		}
+	}
+	available := make([]string, 0, len(list.Manifests))
+	for _, d := range list.Manifests {
+		available = append(available, d.Platform.String())
+	}
+	return nil, fmt.Errorf("Platform %s not found in manifest list, available: %v", platform, available)
+}
@@ -0,0 +1,80 @@
+package docker
+
+import "testing"
+
+func TestParsePlatform(t *testing.T) {
+	cases := []struct {
+		value      string
+		expected   Platform
+		shouldFail bool
+	}{
+		{
+			value:    "linux/amd64",
+			expected: Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			value:    "Linux/ARM64/v8",
+			expected: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		},
+		{
+			value:      "linux",
+			shouldFail: true,
+		},
+		{
+			value:      "linux/",
+			shouldFail: true,
+		},
+		{
+			value:      "linux/arm/v7/x",
+			shouldFail: true,
+		},
+	}
+	for _, tc := range cases {
+		p, err := ParsePlatform(tc.value)
+		if (err != nil) != tc.shouldFail {
+			t.Fatalf("%q: expected error: %v, got: %v", tc.value, tc.shouldFail, err)
+		}
+		if p != tc.expected {
+			t.Fatalf("%q: expected platform %v, got %v", tc.value, tc.expected, p)
+		}
+	}
+}
+
+func TestDetectMediaType(t *testing.T) {
+	cases := []struct {
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			contentType: "application/vnd.oci.image.index.v1+json; charset=utf-8",
+			body:        "{}",
+			expected:    mediaTypeOCIIndex,
+		},
+		{
+			contentType: "text/plain",
+			body:        `{"schemaVersion": 1, "fsLayers": []}`,
+			expected:    mediaTypeSignedManifestV1,
+		},
+		{
+			contentType: "application/json",
+			body:        `{"schemaVersion": 2, "manifests": []}`,
+			expected:    mediaTypeOCIIndex,
+		},
+		{
+			contentType: "application/json",
+			body:        `{"schemaVersion": 2, "config": {}, "layers": []}`,
+			expected:    mediaTypeOCIManifest,
+		},
+		{
+			contentType: "",
+			body:        `{"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json"}`,
+			expected:    mediaTypeManifestList,
+		},
+	}
+	for _, tc := range cases {
+		if got := detectMediaType(tc.contentType, []byte(tc.body)); got != tc.expected {
+			t.Errorf("%q: expected %s got %s", tc.body, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociRefNameAnnotation holds the tag of a manifest in OCI layout index.json
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ociLayout is an image in OCI Image Layout directory
+type ociLayout struct {
+	dir       string
+	reference string
+}
+
+type ociIndex struct {
+	Manifests []struct {
+		manifestDescriptor
+		Annotations map[string]string
+	}
+}
+
+func (o *ociLayout) load(image *Image) error {
+	data, err := ioutil.ReadFile(filepath.Join(o.dir, "index.json"))
+	if err != nil {
+		return fmt.Errorf("Can't read OCI layout index: %s", err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("Can't decode OCI layout index: %s", err)
+	}
+	var desc *manifestDescriptor
+	for i, d := range index.Manifests {
+		name := d.Annotations[ociRefNameAnnotation]
+		if o.reference == "" && len(index.Manifests) == 1 ||
+			o.reference != "" && (name == o.reference || strings.HasSuffix(name, ":"+o.reference)) {
+			desc = &index.Manifests[i].manifestDescriptor
+			break
+		}
+	}
+	if desc == nil {
+		if o.reference == "" {
+			return fmt.Errorf("OCI layout %s contains %d manifests, select one with oci:dir:tag", o.dir, len(index.Manifests))
+		}
+		return fmt.Errorf("Image %s not found in OCI layout %s", o.reference, o.dir)
+	}
+
+	m, err := o.readManifest(desc)
+	if err != nil {
+		return err
+	}
+	if m.isIndex() {
+		d, err := m.selectPlatform(image.Platform)
+		if err != nil {
+			return err
+		}
+		image.Platform = d.Platform
+		if m, err = o.readManifest(d); err != nil {
+			return err
+		}
+	}
+	if m.isIndex() {
+		return fmt.Errorf("Manifest %s in OCI layout %s is a nested index", m.digest, o.dir)
+	}
+	if err := parseManifest(m, image); err != nil {
+		return err
+	}
+	if err := o.loadHistory(image); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't get history of %s: %s\n", o.dir, err)
+	}
+	return nil
+}
+
+func (o *ociLayout) loadHistory(image *Image) error {
+	blob, _, err := o.openBlob(image.configDigest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(blob, maxConfigSize))
+	if err != nil {
+		return fmt.Errorf("Can't read image config: %s", err)
+	}
+	return image.setHistory(data)
+}
+
+func (o *ociLayout) readManifest(desc *manifestDescriptor) (*manifest, error) {
+	blob, _, err := o.openBlob(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	body, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read manifest %s: %s", desc.Digest, err)
+	}
+	m := &manifest{
+		mediaType: detectMediaType(desc.MediaType, body),
+		body:      body,
+	}
+	if err := m.verify(desc.Digest); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (o *ociLayout) openBlob(digest string) (io.ReadCloser, int64, error) {
+	if !isDigest(digest) {
+		return nil, 0, fmt.Errorf("Invalid digest %s", digest)
+	}
+	parts := strings.SplitN(digest, ":", 2)
+	f, err := os.Open(filepath.Join(o.dir, "blobs", parts[0], parts[1]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Can't open blob: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (o *ociLayout) close() error {
+	return nil
+}
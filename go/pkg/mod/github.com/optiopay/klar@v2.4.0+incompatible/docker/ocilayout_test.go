@@ -0,0 +1,63 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeBlob stores content in OCI layout and returns its digest
+func writeBlob(t *testing.T, dir string, content []byte) string {
+	hex := fmt.Sprintf("%x", sha256.Sum256(content))
+	writeFile(t, filepath.Join(dir, "blobs", "sha256", hex), string(content), 0644)
+	return "sha256:" + hex
+}
+
+func TestOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+
+	config := writeBlob(t, dir, []byte(`{}`))
+	amdLayer := writeBlob(t, dir, []byte("amd64 layer"))
+	armLayer := writeBlob(t, dir, []byte("arm64 layer"))
+	manifestFor := func(layer string) string {
+		return writeBlob(t, dir, []byte(fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "%s",
+			"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "%s"},
+			"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": "%s"}]}`,
+			mediaTypeOCIManifest, config, layer)))
+	}
+	index := writeBlob(t, dir, []byte(fmt.Sprintf(`{"schemaVersion": 2, "manifests": [
+		{"mediaType": "%[1]s", "digest": "%[2]s", "platform": {"os": "linux", "architecture": "amd64"}},
+		{"mediaType": "%[1]s", "digest": "%[3]s", "platform": {"os": "linux", "architecture": "arm64"}}]}`,
+		mediaTypeOCIManifest, manifestFor(amdLayer), manifestFor(armLayer))))
+	writeFile(t, filepath.Join(dir, "index.json"), fmt.Sprintf(`{"schemaVersion": 2, "manifests": [
+		{"mediaType": "%s", "digest": "%s", "annotations": {"%s": "1.0"}}]}`,
+		mediaTypeOCIIndex, index, ociRefNameAnnotation), 0644)
+
+	image, err := NewImage(&Config{ImageName: "oci:" + dir + ":1.0", Platform: "linux/arm64", ServeAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't load OCI layout: %s", err)
+	}
+	defer image.Close()
+	if len(image.FsLayers) != 1 || image.FsLayers[0].BlobSum != armLayer {
+		t.Fatalf("Expected arm64 layer %s, got %v", armLayer, image.FsLayers)
+	}
+	if image.Tag != "1.0" {
+		t.Errorf("Expected tag 1.0, got %s", image.Tag)
+	}
+
+	missing, _ := NewImage(&Config{ImageName: "oci:" + dir + ":2.0"})
+	if err := missing.Pull(); err == nil {
+		t.Fatal("Expected an error for a missing tag")
+	}
+}
@@ -0,0 +1,52 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// proxyBlobs starts the blob server for registry images and points Registry
+// of the images to it. Clair downloads layers from klar, which fetches them
+// from the registry with its own credentials and TLS settings. Only layers
+// of the images are served.
+func (i *Image) proxyBlobs(images ...*Image) error {
+	layers := make(map[string]bool)
+	for _, image := range images {
+		for _, l := range image.FsLayers {
+			layers[l.BlobSum] = true
+		}
+	}
+	i.upstream = i.Registry
+	// registry token is updated by requests, fetches are serialized
+	// until the response headers arrive
+	var mu sync.Mutex
+	err := i.serveBlobs(func(digest string) (io.ReadCloser, int64, error) {
+		if !layers[digest] {
+			return nil, 0, fmt.Errorf("Blob %s is not a layer of the image", digest)
+		}
+		mu.Lock()
+		resp, err := i.FetchBlob(digest)
+		mu.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+		return resp.Body, resp.ContentLength, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		image.Registry, image.upstream = i.Registry, i.upstream
+	}
+	return nil
+}
+
+// registryURL returns base URL of the registry API, which is not Registry
+// if layers are proxied
+func (i *Image) registryURL() string {
+	if i.upstream != "" {
+		return i.upstream
+	}
+	return i.Registry
+}
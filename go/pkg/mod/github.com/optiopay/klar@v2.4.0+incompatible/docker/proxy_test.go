@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyBlobs(t *testing.T) {
+	r := newTokenRegistry(t)
+	defer r.server.Close()
+	image, err := NewImage(&Config{
+		ImageName: "registry.domain.com/nginx:1b29e1531c",
+		User:      "user",
+		Password:  "password",
+		Proxy:     true,
+		ServeAddr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Registry = r.server.URL
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	defer image.Close()
+	if image.Registry == r.server.URL {
+		t.Fatal("Expected Registry to point to the proxy")
+	}
+	if auth := image.Authorization(); auth != "" {
+		t.Errorf("Expected no credentials for Clair, got %s", auth)
+	}
+
+	resp, err := http.Get(image.Registry + "/" + image.Name + "/blobs/" + image.FsLayers[0].BlobSum)
+	if err != nil {
+		t.Fatalf("Can't get layer from proxy: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "blob" {
+		t.Fatalf("Unexpected proxy response %d: %q", resp.StatusCode, body)
+	}
+
+	// the registry has the blob, but it is not a layer of the image
+	resp, err = http.Get(image.Registry + "/" + image.Name + "/blobs/" + image.configDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a blob which is not a layer, got %d", resp.StatusCode)
+	}
+
+	// private layers are not proxied without the token of the scan
+	base := strings.TrimSuffix(image.Registry, "/v2")
+	tokenless := base[:strings.LastIndex(base, "/")] + "/v2"
+	resp, err = http.Get(tokenless + "/" + image.Name + "/blobs/" + image.FsLayers[0].BlobSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without the token, got %d", resp.StatusCode)
+	}
+}
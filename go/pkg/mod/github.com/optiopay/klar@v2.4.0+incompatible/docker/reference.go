@@ -0,0 +1,160 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+)
+
+// The grammar follows github.com/docker/distribution/reference:
+//
+//	reference       := name [ ":" tag ] [ "@" digest ]
+//	name            := [domain '/'] path-component ['/' path-component]*
+//	domain          := host [':' port-number]
+//	host            := domain-name | IPv4address | \[ IPv6address \]
+//	domain-name     := domain-component ['.' domain-component]*
+//	domain-component := /([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])/
+//	port-number     := /[0-9]+/
+//	path-component  := alpha-numeric [separator alpha-numeric]*
+//	alpha-numeric   := /[a-z0-9]+/
+//	separator       := /[_.]|__|[-]*/
+//	tag             := /[\w][\w.-]{0,127}/
+//	digest          := digest-algorithm ":" digest-hex
+//	digest-algorithm := /[A-Za-z][A-Za-z0-9]*([-_+.][A-Za-z][A-Za-z0-9]*)*/
+//	digest-hex      := /[0-9a-fA-F]{32,}/
+const (
+	alphaNumeric     = `[a-z0-9]+`
+	separator        = `(?:[._]|__|[-]*)`
+	pathComponent    = alphaNumeric + `(?:` + separator + alphaNumeric + `)*`
+	domainComponent  = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	ipv6Address      = `\[(?:[a-fA-F0-9:]+)\]`
+	domainName       = domainComponent + `(?:\.` + domainComponent + `)*`
+	domainExpression = `(?:` + domainName + `|` + ipv6Address + `)(?::[0-9]+)?`
+	tagExpression    = `[\w][\w.-]{0,127}`
+	digestExpression = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*[:][[:xdigit:]]{32,}`
+	nameExpression   = `(?:(` + domainExpression + `)/)?(` + pathComponent + `(?:/` + pathComponent + `)*)`
+
+	nameTotalLengthMax = 255
+
+	dockerHubDomain  = "docker.io"
+	dockerHubLegacy  = "index.docker.io"
+	officialRepoPath = "library"
+)
+
+var (
+	referenceRe      = regexp.MustCompile(`^(` + nameExpression + `)(?::(` + tagExpression + `))?(?:@(` + digestExpression + `))?$`)
+	anchoredDigestRe = regexp.MustCompile(`^` + digestExpression + `$`)
+)
+
+// Reference is a parsed and normalised image reference
+type Reference struct {
+	// Domain is a registry host with an optional port, docker.io for Docker Hub
+	Domain string
+	// Path is a repository path, official Docker Hub images get library/ prefix
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// ParseReference parses image reference in any form accepted by docker pull,
+// e.g. postgres, registry:5000/team/app:1.0 or app:1.0@sha256:...
+// Docker Hub references are normalised to docker.io/library/name.
+// Tag defaults to latest only if neither a tag nor a digest is given.
+func ParseReference(s string) (Reference, error) {
+	if s == "" {
+		return Reference{}, fmt.Errorf("Image reference is empty")
+	}
+	domain, remainder := splitDomain(s)
+	matches := referenceRe.FindStringSubmatch(domain + "/" + remainder)
+	if matches == nil {
+		if referenceRe.MatchString(domain + "/" + strings.ToLower(remainder)) {
+			return Reference{}, fmt.Errorf("Repository name must be lowercase: %s", s)
+		}
+		return Reference{}, fmt.Errorf("Invalid reference format: %s", s)
+	}
+	if len(matches[1]) > nameTotalLengthMax {
+		return Reference{}, fmt.Errorf("Repository name must not be more than %d characters: %s", nameTotalLengthMax, s)
+	}
+	ref := Reference{
+		Domain: matches[2],
+		Path:   matches[3],
+		Tag:    matches[4],
+		Digest: matches[5],
+	}
+	if ref.Domain == dockerHubLegacy {
+		ref.Domain = dockerHubDomain
+	}
+	if ref.Domain == dockerHubDomain && !strings.Contains(ref.Path, "/") {
+		ref.Path = officialRepoPath + "/" + ref.Path
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// splitDomain separates registry host from the rest of the reference.
+// The first component is a domain only if it looks like a host name:
+// contains a dot or a port, or it is localhost.
+func splitDomain(s string) (string, string) {
+	i := strings.IndexRune(s, '/')
+	if i == -1 {
+		return dockerHubDomain, s
+	}
+	first := s[:i]
+	if first != "localhost" && !strings.ContainsAny(first, ".:") && strings.ToLower(first) == first {
+		return dockerHubDomain, s
+	}
+	return first, s[i+1:]
+}
+
+// Name returns repository name including the domain
+func (r Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// String returns full normalised reference
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Registry returns host used for registry API requests
+func (r Reference) Registry() string {
+	if r.Domain == dockerHubDomain {
+		return dockerHub
+	}
+	return r.Domain
+}
+
+func isDigest(s string) bool {
+	return anchoredDigestRe.MatchString(s)
+}
+
+// verifyDigest checks content against digest of the form algorithm:hex
+func verifyDigest(digest string, content []byte) error {
+	parts := strings.SplitN(digest, ":", 2)
+	var h hash.Hash
+	switch parts[0] {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("Unsupported digest algorithm %s", parts[0])
+	}
+	h.Write(content)
+	if actual := fmt.Sprintf("%s:%x", parts[0], h.Sum(nil)); actual != strings.ToLower(digest) {
+		return fmt.Errorf("Manifest digest mismatch: expected %s, got %s", digest, actual)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package docker
+
+import "testing"
+
+const testDigest = "sha256:f6a2b81d981ace74aeafb2ed2982d52984d82958bfe836b82cbe4bf1ba440999"
+
+func TestParseReference(t *testing.T) {
+	tcs := map[string]struct {
+		input      string
+		expected   Reference
+		shouldFail bool
+	}{
+		"official": {
+			input:    "postgres",
+			expected: Reference{Domain: "docker.io", Path: "library/postgres", Tag: "latest"},
+		},
+		"official_tag": {
+			input:    "postgres:9.5.1",
+			expected: Reference{Domain: "docker.io", Path: "library/postgres", Tag: "9.5.1"},
+		},
+		"hub_user": {
+			input:    "skynetservices/skydns:2.3",
+			expected: Reference{Domain: "docker.io", Path: "skynetservices/skydns", Tag: "2.3"},
+		},
+		"hub_explicit": {
+			input:    "docker.io/postgres",
+			expected: Reference{Domain: "docker.io", Path: "library/postgres", Tag: "latest"},
+		},
+		"hub_legacy": {
+			input:    "index.docker.io/library/postgres:13",
+			expected: Reference{Domain: "docker.io", Path: "library/postgres", Tag: "13"},
+		},
+		"registry_port": {
+			input:    "172.31.29.60:5000/flask-lab-training:latest",
+			expected: Reference{Domain: "172.31.29.60:5000", Path: "flask-lab-training", Tag: "latest"},
+		},
+		"registry_port_digest": {
+			input:    "registry:5000/team/app@" + testDigest,
+			expected: Reference{Domain: "registry:5000", Path: "team/app", Digest: testDigest},
+		},
+		"tag_digest": {
+			input:    "name:tag@" + testDigest,
+			expected: Reference{Domain: "docker.io", Path: "library/name", Tag: "tag", Digest: testDigest},
+		},
+		"localhost": {
+			input:    "localhost/nginx",
+			expected: Reference{Domain: "localhost", Path: "nginx", Tag: "latest"},
+		},
+		"localhost_port": {
+			input:    "localhost:8080/nginx:xxx",
+			expected: Reference{Domain: "localhost:8080", Path: "nginx", Tag: "xxx"},
+		},
+		"ipv6": {
+			input:    "[2001:db8::1]:5000/app:1",
+			expected: Reference{Domain: "[2001:db8::1]:5000", Path: "app", Tag: "1"},
+		},
+		"separators": {
+			input:    "quay.io/coreos/clair__test-x.y:v2.0.1",
+			expected: Reference{Domain: "quay.io", Path: "coreos/clair__test-x.y", Tag: "v2.0.1"},
+		},
+		"uppercase_tag": {
+			input:    "nginx:Mainline_1.0",
+			expected: Reference{Domain: "docker.io", Path: "library/nginx", Tag: "Mainline_1.0"},
+		},
+		"uppercase_domain": {
+			input:    "Registry.Example.com/app",
+			expected: Reference{Domain: "Registry.Example.com", Path: "app", Tag: "latest"},
+		},
+		"uppercase_name": {
+			input:      "Nginx",
+			shouldFail: true,
+		},
+		"empty": {
+			input:      "",
+			shouldFail: true,
+		},
+		"short_digest": {
+			input:      "nginx@sha256:abc",
+			shouldFail: true,
+		},
+		"double_tag": {
+			input:      "nginx:1:2",
+			shouldFail: true,
+		},
+		"trailing_slash": {
+			input:      "registry:5000/",
+			shouldFail: true,
+		},
+		"leading_separator": {
+			input:      "registry/-app",
+			shouldFail: true,
+		},
+	}
+	for name, tc := range tcs {
+		ref, err := ParseReference(tc.input)
+		if (err != nil) != tc.shouldFail {
+			t.Errorf("%s: expected error: %v, got: %v", name, tc.shouldFail, err)
+			continue
+		}
+		if tc.shouldFail {
+			continue
+		}
+		if ref != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", name, tc.expected, ref)
+		}
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	ref, err := ParseReference("app:1.0@" + testDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "docker.io/library/app:1.0@" + testDigest; ref.String() != expected {
+		t.Errorf("expected %s got %s", expected, ref.String())
+	}
+	if ref.Registry() != dockerHub {
+		t.Errorf("expected registry %s got %s", dockerHub, ref.Registry())
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	content := []byte("{}")
+	if err := verifyDigest("sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", content); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := verifyDigest(testDigest, content); err == nil {
+		t.Error("expected digest mismatch")
+	}
+	if err := verifyDigest("md5:d41d8cd98f00b204e9800998ecf8427e", content); err == nil {
+		t.Error("expected unsupported algorithm")
+	}
+}
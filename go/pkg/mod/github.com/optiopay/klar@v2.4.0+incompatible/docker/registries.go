@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/optiopay/klar/utils"
+)
+
+// RegistryConfig holds connection settings of a registry host
+type RegistryConfig struct {
+	// CAFile is a PEM bundle verifying the registry instead of system roots
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate for the registry
+	CertFile string
+	KeyFile  string
+	// Insecure skips verification of the registry certificate
+	Insecure bool
+	// PlainHTTP connects to the registry with HTTP instead of HTTPS
+	PlainHTTP bool
+	// Mirrors are tried in order before the registry, e.g. a pull-through
+	// cache. A mirror is host[:port] or a URL, its own settings apply.
+	Mirrors []string
+}
+
+// endpoint is the registry or a mirror an image is pulled from
+type endpoint struct {
+	registry string
+	client   *http.Client
+	auth     *authenticator
+	token    string
+	scope    *bearerScope
+}
+
+// TLSConfig returns the TLS configuration of the registry, insecure skips
+// verification as DOCKER_INSECURE does for all registries
+func (r RegistryConfig) TLSConfig(insecure bool) (*tls.Config, error) {
+	conf, err := utils.LoadTLSConfig(r.CAFile, r.CertFile, r.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf.InsecureSkipVerify = insecure || r.Insecure
+	return conf, nil
+}
+
+// registry returns settings of the registry host, Docker Hub settings
+// can be given for any of its host names
+func (conf *Config) registry(host string) RegistryConfig {
+	if r, ok := conf.Registries[host]; ok {
+		return r
+	}
+	switch host {
+	case dockerHubDomain, dockerHubLegacy, dockerHub:
+		for _, name := range []string{dockerHubDomain, dockerHubLegacy, dockerHub} {
+			if r, ok := conf.Registries[name]; ok {
+				return r
+			}
+		}
+	}
+	return RegistryConfig{}
+}
+
+// registryClient returns the HTTP client for requests to the registry host
+func (conf *Config) registryClient(host string) (*http.Client, error) {
+	tlsConfig, err := conf.registry(host).TLSConfig(conf.InsecureTLS)
+	if err != nil {
+		return nil, fmt.Errorf("Can't configure TLS of %s: %s", host, err)
+	}
+	return &http.Client{
+		Transport: utils.NewTransport(tlsConfig, conf.Timeout, conf.Retries, conf.Context),
+	}, nil
+}
+
+// registryURL returns the registry API URL of the host
+func (conf *Config) registryURL(host string) string {
+	if conf.InsecureRegistry || conf.registry(host).PlainHTTP {
+		return fmt.Sprintf("http://%s/v2", host)
+	}
+	return fmt.Sprintf("https://%s/v2", host)
+}
+
+// mirrorEndpoints returns endpoints of the mirrors of the registry host.
+// Registry credentials are not sent to mirrors, they get credentials of
+// their own host from the Docker config.
+func (conf *Config) mirrorEndpoints(host string) ([]endpoint, error) {
+	var endpoints []endpoint
+	for _, mirror := range conf.registry(host).Mirrors {
+		mirrorHost, registry := mirror, ""
+		if i := strings.Index(mirror, "://"); i != -1 {
+			mirrorHost = strings.TrimSuffix(mirror[i+3:], "/")
+			registry = strings.TrimSuffix(mirror, "/") + "/v2"
+		} else {
+			registry = conf.registryURL(mirrorHost)
+		}
+		client, err := conf.registryClient(mirrorHost)
+		if err != nil {
+			return nil, err
+		}
+		var user, password, identityToken string
+		creds, err := lookupCredentials(conf.ConfigDir, mirrorHost)
+		if err != nil {
+			return nil, fmt.Errorf("Can't get credentials for %s: %s", mirrorHost, err)
+		}
+		if creds != nil {
+			user, password, identityToken = creds.Username, creds.Password, creds.IdentityToken
+		}
+		endpoints = append(endpoints, endpoint{
+			registry: registry,
+			client:   client,
+			auth:     newAuthenticator(client, user, password, "", identityToken),
+		})
+	}
+	return endpoints, nil
+}
+
+func (i *Image) endpoint() endpoint {
+	return endpoint{registry: i.Registry, client: i.client, auth: i.auth, token: i.Token, scope: i.scope}
+}
+
+func (i *Image) useEndpoint(e endpoint) {
+	i.Registry, i.client, i.auth, i.Token, i.scope = e.registry, e.client, e.auth, e.token, e.scope
+}
+
+// pullReferenceManifest pulls the manifest of the image reference from the
+// first mirror which has it and from the registry if none has. The image
+// then uses the endpoint which had the manifest for all requests.
+func (i *Image) pullReferenceManifest() (*manifest, error) {
+	registry := i.endpoint()
+	for _, mirror := range i.mirrors {
+		i.useEndpoint(mirror)
+		m, err := i.pullManifest(i.reference())
+		if err == nil {
+			return m, nil
+		}
+		fmt.Fprintf(os.Stderr, "Can't pull %s from mirror %s: %s\n", i.Name, mirror.registry, err)
+	}
+	i.useEndpoint(registry)
+	return i.pullManifest(i.reference())
+}
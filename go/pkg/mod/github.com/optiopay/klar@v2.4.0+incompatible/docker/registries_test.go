@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistrySettings(t *testing.T) {
+	conf := &Config{Registries: map[string]RegistryConfig{
+		"docker.io":            {Mirrors: []string{"mirror.test"}},
+		"registry.test:5000":   {PlainHTTP: true},
+		"untrusted.test":       {Insecure: true},
+		"missing-ca.test":      {CAFile: "testdata/missing.pem"},
+		"registry-no-key.test": {CertFile: "testdata/client.crt"},
+	}}
+	for _, host := range []string{"docker.io", "index.docker.io", "registry-1.docker.io"} {
+		if mirrors := conf.registry(host).Mirrors; len(mirrors) != 1 {
+			t.Errorf("Expected Docker Hub settings for %s, got %v", host, mirrors)
+		}
+	}
+	if url := conf.registryURL("registry.test:5000"); url != "http://registry.test:5000/v2" {
+		t.Errorf("Expected plain HTTP registry URL, got %s", url)
+	}
+	if url := conf.registryURL("registry.test"); url != "https://registry.test/v2" {
+		t.Errorf("Expected HTTPS registry URL, got %s", url)
+	}
+	tlsConfig, err := conf.registry("untrusted.test").TLSConfig(false)
+	if err != nil || !tlsConfig.InsecureSkipVerify {
+		t.Errorf("Expected insecure TLS config, got %v, %v", tlsConfig, err)
+	}
+	if _, err := NewImage(&Config{ImageName: "missing-ca.test/nginx", Registries: conf.Registries}); err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+	if _, err := NewImage(&Config{ImageName: "registry-no-key.test/nginx", Registries: conf.Registries}); err == nil {
+		t.Error("Expected an error for a client certificate without a key")
+	}
+
+	image, err := NewImage(&Config{ImageName: "nginx", Registries: conf.Registries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image.mirrors) != 1 || image.mirrors[0].registry != "https://mirror.test/v2" {
+		t.Errorf("Expected mirror.test mirror, got %+v", image.mirrors)
+	}
+}
+
+func TestPullMirror(t *testing.T) {
+	manifest, err := ioutil.ReadFile("testdata/registry-response-schemav2.json")
+	if err != nil {
+		t.Fatalf("Can't load registry test response %s", err.Error())
+	}
+	serve := func(hits *int, tags ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				*hits++
+			}
+			for _, tag := range tags {
+				if strings.HasSuffix(r.URL.Path, "/manifests/"+tag) {
+					w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+					fmt.Fprintln(w, string(manifest))
+					return
+				}
+			}
+			http.NotFound(w, r)
+		}))
+	}
+	var registryHits, mirrorHits int
+	registry := serve(&registryHits, "cached", "latest")
+	defer registry.Close()
+	mirror := serve(&mirrorHits, "cached")
+	defer mirror.Close()
+	conf := &Config{Retries: -1, Registries: map[string]RegistryConfig{
+		"registry.test": {Mirrors: []string{mirror.URL}},
+	}}
+
+	conf.ImageName = "registry.test/nginx:cached"
+	image, err := NewImage(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Registry = registry.URL + "/v2"
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	if image.Registry != mirror.URL+"/v2" || registryHits != 0 {
+		t.Errorf("Expected the image pulled from the mirror, got %s with %d registry requests", image.Registry, registryHits)
+	}
+
+	// the registry is used if the mirror doesn't have the image
+	conf.ImageName = "registry.test/nginx:latest"
+	image, err = NewImage(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Registry = registry.URL + "/v2"
+	if err := image.Pull(); err != nil {
+		t.Fatalf("Can't pull image: %s", err)
+	}
+	if image.Registry != registry.URL+"/v2" || registryHits != 1 || mirrorHits != 2 {
+		t.Errorf("Expected the image pulled from the registry, got %s with %d registry and %d mirror requests",
+			image.Registry, registryHits, mirrorHits)
+	}
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+	"io"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/optiopay/klar/clair"
@@ -19,6 +18,16 @@ var SeverityStyle = map[string]string{
 	"Unknown":    "\033[0;97m%s\033[0m",
 }
 
+// documentFormats write one report for all scanned images after the scans
+// are finished
+var documentFormats = map[string]func(w io.Writer, conf *config, results []*scanResult) error{
+	"sarif":    sarifFormat,
+	"junit":    junitFormat,
+	"html":     htmlFormat,
+	"template": templateFormat,
+	"json":     jsonReportFormat,
+}
+
 func getSeverityStyle(status string) string {
 	if val, ok := SeverityStyle[status]; ok {
 		// Return matched style
@@ -29,16 +38,20 @@ func getSeverityStyle(status string) string {
 	return fmt.Sprintf(SeverityStyle["Unknown"], status)
 }
 
-func standardFormat(conf *config, vs []*clair.Vulnerability) int {
+func standardFormat(w io.Writer, conf *config, store map[string][]*clair.Vulnerability) int {
 	vsNumber := 0
-	iteratePriorities(priorities[0], func(sev string) { fmt.Printf("%s: %d\n", sev, len(store[sev])) })
-	fmt.Printf("\n")
+	iteratePriorities(priorities[0], store, func(sev string) { fmt.Fprintf(w, "%s: %d\n", sev, len(store[sev])) })
+	fmt.Fprintf(w, "\n")
 
-	iteratePriorities(conf.ClairOutput, func(sev string) {
+	iteratePriorities(conf.ClairOutput, store, func(sev string) {
 		for _, v := range store[sev] {
-			fmt.Printf("%s: [%s] \nFound in: %s [%s]\nFixed By: %s\n%s\n%s\n", v.Name, v.Severity, v.FeatureName,
-				v.FeatureVersion, v.FixedBy, v.Description, v.Link)
-			fmt.Println("-----------------------------------------")
+			fmt.Fprintf(w, "%s: [%s] \nFound in: %s [%s]\nFixed By: %s\n", v.Name, v.Severity, v.FeatureName,
+				v.FeatureVersion, v.FixedBy)
+			if v.Instruction != "" {
+				fmt.Fprintf(w, "Added By: %s\n", v.Instruction)
+			}
+			fmt.Fprintf(w, "%s\n%s\n", v.Description, v.Link)
+			fmt.Fprintln(w, "-----------------------------------------")
 			if conf.IgnoreUnfixed {
 				if v.FixedBy != "" {
 					vsNumber++
@@ -51,9 +64,10 @@ func standardFormat(conf *config, vs []*clair.Vulnerability) int {
 	return vsNumber
 }
 
-func jsonFormat(conf *config, output jsonOutput) int {
+// collectJSONOutput fills output with vulnerabilities from the store
+func collectJSONOutput(conf *config, store map[string][]*clair.Vulnerability, output jsonOutput) int {
 	vsNumber := 0
-	iteratePriorities(conf.ClairOutput, func(sev string) {
+	iteratePriorities(conf.ClairOutput, store, func(sev string) {
 		if conf.IgnoreUnfixed {
 			// need to iterate over store[sev]
 			for _, v := range store[sev] {
@@ -66,21 +80,28 @@ func jsonFormat(conf *config, output jsonOutput) int {
 		}
 		output.Vulnerabilities[sev] = store[sev]
 	})
-	enc := json.NewEncoder(os.Stdout)
-	enc.Encode(output)
-
 	return vsNumber
 }
 
-func tableFormat(conf *config, vs []*clair.Vulnerability) int {
+func tableFormat(w io.Writer, conf *config, store map[string][]*clair.Vulnerability) int {
 	vsNumber := 0
-	iteratePriorities(priorities[0], func(sev string) { fmt.Printf("%s: %d\n", sev, len(store[sev])) })
-	fmt.Printf("\n")
+	iteratePriorities(priorities[0], store, func(sev string) { fmt.Fprintf(w, "%s: %d\n", sev, len(store[sev])) })
+	fmt.Fprintf(w, "\n")
 
-	table := tablewriter.NewWriter(os.Stdout)
+	table := tablewriter.NewWriter(w)
 	header := []string{
 		"Severity", "Name", "FeatureName", "FeatureVersion", "FixedBy", "Description", "Link",
 	}
+	// the instruction column is shown if the image has a history
+	instructions := false
+	iteratePriorities(conf.ClairOutput, store, func(sev string) {
+		for _, v := range store[sev] {
+			instructions = instructions || v.Instruction != ""
+		}
+	})
+	if instructions {
+		header = append(header, "AddedBy")
+	}
 	table.SetHeader(header)
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetRowSeparator("-")
@@ -89,9 +110,9 @@ func tableFormat(conf *config, vs []*clair.Vulnerability) int {
 
 	var data [][]string
 
-	iteratePriorities(conf.ClairOutput, func(sev string) {
+	iteratePriorities(conf.ClairOutput, store, func(sev string) {
 		for _, v := range store[sev] {
-			data = append(data, []string{
+			row := []string{
 				getSeverityStyle(v.Severity),
 				v.Name,
 				v.FeatureName,
@@ -99,7 +120,11 @@ func tableFormat(conf *config, vs []*clair.Vulnerability) int {
 				v.FixedBy,
 				v.Description,
 				v.Link,
-			})
+			}
+			if instructions {
+				row = append(row, v.Instruction)
+			}
+			data = append(data, row)
 
 			if conf.IgnoreUnfixed {
 				if v.FixedBy != "" {
@@ -119,7 +144,7 @@ func tableFormat(conf *config, vs []*clair.Vulnerability) int {
 	return vsNumber
 }
 
-func iteratePriorities(output string, f func(sev string)) {
+func iteratePriorities(output string, store map[string][]*clair.Vulnerability, f func(sev string)) {
 	filtered := true
 	for _, sev := range priorities {
 		if filtered {
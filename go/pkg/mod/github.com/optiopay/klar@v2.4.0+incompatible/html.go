@@ -0,0 +1,247 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+type htmlReport struct {
+	Version   string
+	Generated string
+	Images    []htmlImage
+}
+
+type htmlImage struct {
+	Name       string
+	Platform   string
+	Digest     string
+	Error      string
+	LayerCount int
+	Counts     []htmlCount
+	// Counted is the number of vulnerabilities which count towards the threshold
+	Counted   int
+	Threshold int
+	// Policy is set if KLAR_POLICY is, Violations then replace the threshold
+	Policy          bool
+	Violations      []policyViolation
+	Vulnerabilities []htmlVulnerability
+	Whitelisted     []htmlVulnerability
+}
+
+type htmlCount struct {
+	Severity string
+	Count    int
+}
+
+type htmlVulnerability struct {
+	Severity string
+	// Rank orders severities when the table is sorted
+	Rank        int
+	Name        string
+	Package     string
+	Version     string
+	FixedBy     string
+	Layer       string
+	Instruction string
+	Link        string
+	Description string
+	// WhitelistEntry is set for whitelisted vulnerabilities
+	WhitelistEntry *templateWhitelistEntry
+}
+
+// htmlFormat writes a single HTML file without external resources with
+// severity counts, a sortable and filterable table of vulnerabilities at
+// or above CLAIR_OUTPUT and whitelisted vulnerabilities of every image
+func htmlFormat(w io.Writer, conf *config, results []*scanResult) error {
+	report := htmlReport{
+		Version:   version,
+		Generated: time.Now().UTC().Format(time.RFC1123),
+	}
+	for _, r := range results {
+		if r.err != nil {
+			report.Images = append(report.Images, htmlImage{Name: r.image, Error: r.err.Error()})
+			continue
+		}
+		for _, rep := range r.reports {
+			report.Images = append(report.Images, newHTMLImage(conf, rep))
+		}
+	}
+	return htmlTemplate.Execute(w, report)
+}
+
+func newHTMLImage(conf *config, rep *report) htmlImage {
+	image := htmlImage{
+		Name:       rep.Image,
+		Platform:   rep.Platform,
+		Digest:     rep.Digest,
+		LayerCount: rep.LayerCount,
+		Counted:    rep.countVulnerabilities(conf),
+		Threshold:  conf.Threshold,
+		Policy:     conf.policy != nil,
+		Violations: rep.Violations,
+	}
+	store := groupBySeverity(rep.Vulnerabilities)
+	iteratePriorities(priorities[0], store, func(sev string) {
+		image.Counts = append(image.Counts, htmlCount{Severity: sev, Count: len(store[sev])})
+	})
+	iteratePriorities(conf.ClairOutput, store, func(sev string) {
+		for _, v := range store[sev] {
+			image.Vulnerabilities = append(image.Vulnerabilities, newHTMLVulnerability(rep, v))
+		}
+	})
+	for _, v := range rep.Whitelisted {
+		vuln := newHTMLVulnerability(rep, v)
+		entry := newTemplateWhitelistEntry(rep.whitelistedBy[v])
+		vuln.WhitelistEntry = &entry
+		image.Whitelisted = append(image.Whitelisted, vuln)
+	}
+	return image
+}
+
+func newHTMLVulnerability(rep *report, v *clair.Vulnerability) htmlVulnerability {
+	return htmlVulnerability{
+		Severity:    v.Severity,
+		Rank:        severityIndex(v.Severity),
+		Name:        v.Name,
+		Package:     v.FeatureName,
+		Version:     v.FeatureVersion,
+		FixedBy:     v.FixedBy,
+		Layer:       rep.layerDigest(v),
+		Instruction: v.Instruction,
+		Link:        v.Link,
+		Description: v.Description,
+	}
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"shortDigest": func(d string) string {
+		if len(d) > 19 {
+			return d[:19]
+		}
+		return d
+	},
+}).Parse(htmlTemplateText))
+
+const htmlTemplateText = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Klar vulnerability report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { margin-top: 2em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; width: 100%; margin: 1em 0; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+table.vulnerabilities th { cursor: pointer; }
+table.counts { width: auto; }
+.meta { color: #666; }
+.error { color: #b00; font-weight: bold; }
+.Defcon1, .Critical { background: #b00; color: #fff; }
+.High { background: #e33; color: #fff; }
+.Medium { background: #f93; }
+.Low, .Negligible { background: #9cf; }
+details { max-width: 40em; }
+</style>
+</head>
+<body>
+<h1>Klar vulnerability report</h1>
+<p class="meta">Generated {{.Generated}} by klar {{.Version}}</p>
+<p>
+<input id="filter" type="search" placeholder="Filter vulnerabilities" size="40">
+<select id="severity">
+<option value="">All severities</option>
+<option>Defcon1</option><option>Critical</option><option>High</option><option>Medium</option>
+<option>Low</option><option>Negligible</option><option>Unknown</option>
+</select>
+</p>
+{{range .Images}}
+<h2>{{.Name}}{{if .Platform}} {{.Platform}}{{end}}</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{else}}
+<p class="meta">{{if .Digest}}{{.Digest}}, {{end}}{{.LayerCount}} layers{{if not .Policy}},
+{{.Counted}} vulnerabilities counted towards the threshold of {{.Threshold}}{{end}}</p>
+{{if .Policy}}{{if .Violations}}
+<p class="error">Policy violations</p>
+<ul class="violations">
+{{range .Violations}}<li>{{.Rule}}: {{.Message}}</li>
+{{end}}</ul>
+{{else}}<p>Policy passed.</p>{{end}}{{end}}
+<table class="counts">
+<tr>{{range .Counts}}<th class="{{.Severity}}">{{.Severity}}</th>{{end}}</tr>
+<tr>{{range .Counts}}<td>{{.Count}}</td>{{end}}</tr>
+</table>
+{{if .Vulnerabilities}}
+<table class="vulnerabilities">
+<thead><tr><th>Severity</th><th>Vulnerability</th><th>Package</th><th>Installed version</th><th>Fixed by</th><th>Layer</th><th>Added by</th></tr></thead>
+<tbody>
+{{range .Vulnerabilities}}{{template "row" .}}{{end}}
+</tbody>
+</table>
+{{else}}<p>No vulnerabilities found.</p>{{end}}
+{{if .Whitelisted}}
+<h3>Whitelisted</h3>
+<table class="vulnerabilities">
+<thead><tr><th>Severity</th><th>Vulnerability</th><th>Package</th><th>Installed version</th><th>Fixed by</th><th>Layer</th><th>Added by</th><th>Owner</th><th>Reason</th><th>Expires</th></tr></thead>
+<tbody>
+{{range .Whitelisted}}{{template "row" .}}{{end}}
+</tbody>
+</table>
+{{end}}
+{{end}}
+{{end}}
+<script>
+(function() {
+  var filter = document.getElementById("filter");
+  var severity = document.getElementById("severity");
+  function apply() {
+    var text = filter.value.toLowerCase();
+    var rows = document.querySelectorAll("table.vulnerabilities tbody tr");
+    for (var i = 0; i < rows.length; i++) {
+      var row = rows[i];
+      var visible = row.textContent.toLowerCase().indexOf(text) !== -1 &&
+        (severity.value === "" || row.getAttribute("data-severity") === severity.value);
+      row.style.display = visible ? "" : "none";
+    }
+  }
+  filter.addEventListener("input", apply);
+  severity.addEventListener("change", apply);
+
+  var headers = document.querySelectorAll("table.vulnerabilities th");
+  for (var i = 0; i < headers.length; i++) {
+    headers[i].addEventListener("click", function() {
+      var th = this, column = th.cellIndex;
+      var tbody = th.parentNode.parentNode.parentNode.tBodies[0];
+      var rows = Array.prototype.slice.call(tbody.rows);
+      var desc = th.getAttribute("data-order") !== "desc";
+      th.setAttribute("data-order", desc ? "desc" : "asc");
+      rows.sort(function(a, b) {
+        var x = a.cells[column].getAttribute("data-sort") || a.cells[column].textContent;
+        var y = b.cells[column].getAttribute("data-sort") || b.cells[column].textContent;
+        var cmp = column === 0 ? Number(x) - Number(y) : x.localeCompare(y);
+        return desc ? -cmp : cmp;
+      });
+      for (var j = 0; j < rows.length; j++) {
+        tbody.appendChild(rows[j]);
+      }
+    });
+  }
+})();
+</script>
+</body>
+</html>
+{{define "row"}}<tr data-severity="{{.Severity}}">
+<td class="{{.Severity}}" data-sort="{{.Rank}}">{{.Severity}}</td>
+<td>{{if .Link}}<a href="{{.Link}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}{{if .Description}}<details><summary>Description</summary>{{.Description}}</details>{{end}}</td>
+<td>{{.Package}}</td>
+<td>{{.Version}}</td>
+<td>{{.FixedBy}}</td>
+<td title="{{.Layer}}">{{shortDigest .Layer}}</td>
+<td><code>{{.Instruction}}</code></td>
+{{with .WhitelistEntry}}<td>{{.Owner}}</td>
+<td>{{.Reason}}</td>
+<td>{{.Expires}}</td>
+{{end}}</tr>
+{{end}}`
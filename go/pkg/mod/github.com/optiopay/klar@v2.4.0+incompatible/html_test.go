@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+func TestHTMLFormat(t *testing.T) {
+	results := testResults()
+	rep := results[0].reports[0]
+	rep.Vulnerabilities[0].Description = "<script>alert(1)</script>"
+	rep.whitelistedBy = map[*clair.Vulnerability]*whitelistEntry{
+		rep.Whitelisted[0]: {CVE: "CVE-3", Owner: "platform", Reason: "no network", Expires: time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	var buf bytes.Buffer
+	if err := htmlFormat(&buf, &config{ClairOutput: "Medium"}, results); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{
+		"<h2>postgres:9.5.1</h2>",
+		`<tr data-severity="High">`,
+		"<h3>Whitelisted</h3>",
+		"CVE-3",
+		"<th>Owner</th><th>Reason</th><th>Expires</th>",
+		"<td>platform</td>\n<td>no network</td>\n<td>2019-12-31</td>",
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		"Can&#39;t pull image",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected report to contain %s", s)
+		}
+	}
+	// Low is below CLAIR_OUTPUT, it is only counted
+	if strings.Contains(out, "CVE-2") {
+		t.Error("Expected CVE-2 to be left out")
+	}
+	if strings.Contains(out, "<script src") || strings.Contains(out, "<link") {
+		t.Error("Expected no external resources")
+	}
+}
+
+func TestNewHTMLImageCounts(t *testing.T) {
+	rep := &report{Vulnerabilities: []*clair.Vulnerability{
+		{Name: "CVE-1", Severity: "High"},
+		{Name: "CVE-2", Severity: "High"},
+		{Name: "CVE-3", Severity: "Low"},
+	}}
+	image := newHTMLImage(&config{ClairOutput: "Unknown"}, rep)
+	expected := []htmlCount{{"Low", 1}, {"High", 2}}
+	if len(image.Counts) != len(expected) {
+		t.Fatalf("Expected counts %v, got %v", expected, image.Counts)
+	}
+	for i := range expected {
+		if image.Counts[i] != expected[i] {
+			t.Errorf("Expected counts %v, got %v", expected, image.Counts)
+		}
+	}
+}
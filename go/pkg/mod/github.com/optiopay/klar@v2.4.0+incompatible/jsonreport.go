@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+// jsonReportVersion is the current JSON report schema version,
+// the schema is published in report-schema-v2.json
+const jsonReportVersion = 2
+
+type jsonReport struct {
+	SchemaVersion string            `json:"schemaVersion"`
+	KlarVersion   string            `json:"klarVersion"`
+	GeneratedAt   time.Time         `json:"generatedAt"`
+	Options       jsonReportOptions `json:"options"`
+	Images        []jsonReportImage `json:"images"`
+	// OverThreshold is set if any image exceeds the threshold or
+	// violates the policy
+	OverThreshold bool `json:"overThreshold"`
+}
+
+type jsonReportOptions struct {
+	ClairOutput   string `json:"clairOutput"`
+	Threshold     int    `json:"threshold"`
+	IgnoreUnfixed bool   `json:"ignoreUnfixed"`
+}
+
+// jsonReportImage is the report of one image platform or an image which
+// couldn't be analyzed, then only Image and Error are set
+type jsonReportImage struct {
+	Image           string                    `json:"image"`
+	Registry        string                    `json:"registry,omitempty"`
+	Repository      string                    `json:"repository,omitempty"`
+	Tag             string                    `json:"tag,omitempty"`
+	Digest          string                    `json:"digest,omitempty"`
+	Platform        string                    `json:"platform,omitempty"`
+	ClairAPIVersion int                       `json:"clairApiVersion,omitempty"`
+	ScanTime        *time.Time                `json:"scanTime,omitempty"`
+	Cached          bool                      `json:"cached,omitempty"`
+	Error           string                    `json:"error,omitempty"`
+	LayerCount      int                       `json:"layerCount"`
+	Layers          []jsonReportLayer         `json:"layers"`
+	Vulnerabilities []jsonReportVulnerability `json:"vulnerabilities"`
+	Summary         jsonReportSummary         `json:"summary"`
+	Threshold       jsonReportThreshold       `json:"threshold"`
+	// Policy is set if KLAR_POLICY is, it replaces Threshold
+	Policy *jsonReportPolicy `json:"policy,omitempty"`
+	// Baseline is set if the image is compared with a baseline
+	Baseline *jsonReportBaseline `json:"baseline,omitempty"`
+	// Base is set if KLAR_BASE_IMAGE is
+	Base *jsonReportBase `json:"base,omitempty"`
+}
+
+// jsonReportBase splits counted vulnerabilities into inherited from the
+// base image and introduced by the image
+type jsonReportBase struct {
+	Image      string `json:"image"`
+	LayerCount int    `json:"layerCount"`
+	Inherited  int    `json:"inherited"`
+	Introduced int    `json:"introduced"`
+	// Threshold is KLAR_BASE_THRESHOLD, inherited vulnerabilities don't
+	// fail the scan without it
+	Threshold *int `json:"threshold,omitempty"`
+	Exceeded  bool `json:"exceeded"`
+}
+
+type jsonReportBaseline struct {
+	New       int               `json:"new"`
+	Unchanged int               `json:"unchanged"`
+	Fixed     []baselineFinding `json:"fixed"`
+}
+
+type jsonReportPolicy struct {
+	Passed     bool              `json:"passed"`
+	Violations []policyViolation `json:"violations"`
+}
+
+type jsonReportLayer struct {
+	Digest string `json:"digest"`
+	Index  int    `json:"index"`
+	// Instruction is the Dockerfile instruction which created the layer
+	Instruction string `json:"instruction,omitempty"`
+	// VulnerabilityCount is the number of vulnerabilities added by the layer
+	VulnerabilityCount int `json:"vulnerabilityCount"`
+}
+
+type jsonReportVulnerability struct {
+	Name        string            `json:"name"`
+	Severity    string            `json:"severity"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Link        string            `json:"link,omitempty"`
+	FixedBy     string            `json:"fixedBy,omitempty"`
+	Package     jsonReportPackage `json:"package"`
+	Layer       string            `json:"layer,omitempty"`
+	Instruction string            `json:"instruction,omitempty"`
+	// Reported is set if the severity is at least CLAIR_OUTPUT
+	Reported bool `json:"reported"`
+	// Counted is set if the vulnerability counts towards the threshold
+	Counted     bool `json:"counted"`
+	Whitelisted bool `json:"whitelisted"`
+	// Baseline is new or unchanged if the image is compared with a baseline
+	Baseline string `json:"baseline,omitempty"`
+	// Origin is base or image if KLAR_BASE_IMAGE is set
+	Origin string `json:"origin,omitempty"`
+	// WhitelistEntry is the whitelist decision of Whitelisted vulnerabilities
+	WhitelistEntry *jsonReportWhitelistEntry `json:"whitelistEntry,omitempty"`
+	Metadata       interface{}               `json:"metadata,omitempty"`
+}
+
+type jsonReportWhitelistEntry struct {
+	Owner   string   `json:"owner,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Expires string   `json:"expires,omitempty"`
+	Package string   `json:"package,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Images  []string `json:"images,omitempty"`
+}
+
+type jsonReportPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type jsonReportSummary struct {
+	// BySeverity counts not whitelisted vulnerabilities
+	BySeverity  map[string]int `json:"bySeverity"`
+	Counted     int            `json:"counted"`
+	Whitelisted int            `json:"whitelisted"`
+}
+
+type jsonReportThreshold struct {
+	Limit    int  `json:"limit"`
+	Counted  int  `json:"counted"`
+	Exceeded bool `json:"exceeded"`
+}
+
+// jsonReportFormat writes the versioned JSON report of all images,
+// KLAR_JSON_VERSION=1 selects the format before versioned reports
+func jsonReportFormat(w io.Writer, conf *config, results []*scanResult) error {
+	report := jsonReport{
+		SchemaVersion: strconv.Itoa(jsonReportVersion),
+		KlarVersion:   version,
+		GeneratedAt:   time.Now().UTC(),
+		Options: jsonReportOptions{
+			ClairOutput:   conf.ClairOutput,
+			Threshold:     conf.Threshold,
+			IgnoreUnfixed: conf.IgnoreUnfixed,
+		},
+		Images: []jsonReportImage{},
+	}
+	for _, r := range results {
+		if r.err != nil {
+			report.Images = append(report.Images, jsonReportImage{
+				Image:           r.image,
+				Error:           r.err.Error(),
+				Layers:          []jsonReportLayer{},
+				Vulnerabilities: []jsonReportVulnerability{},
+				Summary:         jsonReportSummary{BySeverity: map[string]int{}},
+				Threshold:       jsonReportThreshold{Limit: conf.Threshold},
+			})
+			continue
+		}
+		for _, rep := range r.reports {
+			image := newJSONReportImage(conf, rep)
+			report.OverThreshold = report.OverThreshold || conf.failed(rep)
+			report.Images = append(report.Images, image)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func newJSONReportImage(conf *config, rep *report) jsonReportImage {
+	scanTime := rep.ScanTime
+	counted := rep.countVulnerabilities(conf)
+	image := jsonReportImage{
+		Image:           rep.Image,
+		Registry:        rep.Registry,
+		Repository:      rep.Repository,
+		Tag:             rep.Tag,
+		Digest:          rep.Digest,
+		Platform:        rep.Platform,
+		ClairAPIVersion: rep.ClairAPIVersion,
+		ScanTime:        &scanTime,
+		Cached:          rep.Cached,
+		LayerCount:      rep.LayerCount,
+		Layers:          []jsonReportLayer{},
+		Vulnerabilities: []jsonReportVulnerability{},
+		Summary: jsonReportSummary{
+			BySeverity:  map[string]int{},
+			Counted:     counted,
+			Whitelisted: len(rep.Whitelisted),
+		},
+		Threshold: jsonReportThreshold{
+			Limit:    conf.Threshold,
+			Counted:  counted,
+			Exceeded: counted > conf.Threshold,
+		},
+	}
+	if conf.policy != nil {
+		image.Policy = &jsonReportPolicy{
+			Passed:     len(rep.Violations) == 0,
+			Violations: append([]policyViolation{}, rep.Violations...),
+		}
+	}
+	if rep.unchanged != nil {
+		added := len(rep.added())
+		image.Baseline = &jsonReportBaseline{
+			New:       added,
+			Unchanged: len(rep.Vulnerabilities) - added,
+			Fixed:     append([]baselineFinding{}, rep.Fixed...),
+		}
+	}
+	if conf.base != nil {
+		image.Base = &jsonReportBase{
+			Image:      conf.base.name,
+			LayerCount: rep.BaseLayers,
+			Inherited:  rep.countInherited(conf),
+			Introduced: counted,
+			Exceeded:   conf.baseFailed(rep),
+		}
+		if conf.BaseThreshold >= 0 {
+			threshold := conf.BaseThreshold
+			image.Base.Threshold = &threshold
+		}
+	}
+	layerIndex := make(map[string]int, len(rep.Layers))
+	for i, digest := range rep.Layers {
+		layerIndex[digest] = i
+		layer := jsonReportLayer{Digest: digest, Index: i}
+		if i < len(rep.instructions) {
+			layer.Instruction = rep.instructions[i]
+		}
+		image.Layers = append(image.Layers, layer)
+	}
+	add := func(v *clair.Vulnerability, whitelisted bool) {
+		vuln := newJSONReportVulnerability(conf, rep, v, whitelisted)
+		if i, ok := layerIndex[vuln.Layer]; ok {
+			image.Layers[i].VulnerabilityCount++
+		}
+		image.Vulnerabilities = append(image.Vulnerabilities, vuln)
+	}
+	for _, v := range rep.Vulnerabilities {
+		image.Summary.BySeverity[v.Severity]++
+		add(v, false)
+	}
+	for _, v := range rep.Whitelisted {
+		add(v, true)
+	}
+	return image
+}
+
+func newJSONReportVulnerability(conf *config, rep *report, v *clair.Vulnerability, whitelisted bool) jsonReportVulnerability {
+	vuln := jsonReportVulnerability{
+		Name:        v.Name,
+		Severity:    v.Severity,
+		Namespace:   v.NamespaceName,
+		Description: v.Description,
+		Link:        v.Link,
+		FixedBy:     v.FixedBy,
+		Package:     jsonReportPackage{Name: v.FeatureName, Version: v.FeatureVersion},
+		Layer:       rep.layerDigest(v),
+		Instruction: v.Instruction,
+		Reported:    conf.reported(v),
+		Counted:     !whitelisted && rep.counted(conf, v),
+		Whitelisted: whitelisted,
+	}
+	if rep.unchanged != nil && !whitelisted {
+		vuln.Baseline = "new"
+		if rep.unchanged[v] {
+			vuln.Baseline = "unchanged"
+		}
+	}
+	if conf.base != nil {
+		vuln.Origin = "image"
+		if rep.inherited(v) {
+			vuln.Origin = "base"
+		}
+	}
+	if len(v.Metadata) > 0 {
+		vuln.Metadata = v.Metadata
+	}
+	if e := rep.whitelistedBy[v]; e != nil {
+		vuln.WhitelistEntry = &jsonReportWhitelistEntry{
+			Owner:   e.Owner,
+			Reason:  e.Reason,
+			Expires: e.expiresDate(),
+			Package: e.Package,
+			Version: e.Version,
+			Images:  e.Images,
+		}
+	}
+	return vuln
+}
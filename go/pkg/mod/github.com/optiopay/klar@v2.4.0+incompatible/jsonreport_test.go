@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestJSONReportFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jsonReportFormat(&buf, &config{ClairOutput: "Medium", Threshold: 0}, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	var report jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Can't decode report: %s", err)
+	}
+	if report.SchemaVersion != "2" || !report.OverThreshold || len(report.Images) != 2 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if image := report.Images[1]; image.Image != "nginx:missing" || image.Error == "" {
+		t.Errorf("Expected an error for nginx:missing, got %+v", image)
+	}
+
+	image := report.Images[0]
+	if len(image.Vulnerabilities) != 3 {
+		t.Fatalf("Expected 3 vulnerabilities, got %d", len(image.Vulnerabilities))
+	}
+	expected := map[string]struct {
+		reported, counted, whitelisted bool
+	}{
+		"CVE-1": {true, true, false},
+		"CVE-2": {false, false, false},
+		"CVE-3": {true, false, true},
+	}
+	for _, v := range image.Vulnerabilities {
+		e := expected[v.Name]
+		if v.Reported != e.reported || v.Counted != e.counted || v.Whitelisted != e.whitelisted {
+			t.Errorf("%s: expected %+v, got reported %v, counted %v, whitelisted %v", v.Name, e, v.Reported, v.Counted, v.Whitelisted)
+		}
+	}
+	if v := image.Vulnerabilities[0]; v.Package.Name != "openssl" || v.Layer != "sha256:bbb" || v.Instruction != "RUN apt-get install -y openssl" {
+		t.Errorf("Unexpected package or layer of %+v", v)
+	}
+	if len(image.Layers) != 2 || image.Layers[0].VulnerabilityCount != 0 || image.Layers[1].VulnerabilityCount != 1 ||
+		image.Layers[0].Instruction != "ADD file:abc in /" {
+		t.Errorf("Unexpected layers %+v", image.Layers)
+	}
+	if image.Summary.Counted != 1 || image.Summary.Whitelisted != 1 || image.Summary.BySeverity["High"] != 1 {
+		t.Errorf("Unexpected summary %+v", image.Summary)
+	}
+	if !image.Threshold.Exceeded || image.Threshold.Counted != 1 {
+		t.Errorf("Unexpected threshold %+v", image.Threshold)
+	}
+}
+
+// TestJSONReportSchema checks that the report has the properties
+// required by the published schema
+func TestJSONReportSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("report-schema-v2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Required    []string
+		Definitions map[string]struct {
+			Required []string
+		}
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Can't decode schema: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := jsonReportFormat(&buf, &config{ClairOutput: "Low"}, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	checkRequired := func(name string, obj interface{}, required []string) {
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s is not an object: %v", name, obj)
+		}
+		for _, key := range required {
+			if _, ok := m[key]; !ok {
+				t.Errorf("%s misses required property %s", name, key)
+			}
+		}
+	}
+	checkRequired("report", report, schema.Required)
+	for _, image := range report["images"].([]interface{}) {
+		checkRequired("image", image, schema.Definitions["image"].Required)
+		for _, layer := range image.(map[string]interface{})["layers"].([]interface{}) {
+			checkRequired("layer", layer, schema.Definitions["layer"].Required)
+		}
+		for _, v := range image.(map[string]interface{})["vulnerabilities"].([]interface{}) {
+			checkRequired("vulnerability", v, schema.Definitions["vulnerability"].Required)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/optiopay/klar/clair"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// junitFormat writes a testsuite per image with a testcase per package and
+// vulnerability. Vulnerabilities which count towards the threshold fail,
+// whitelisted ones are skipped and images which couldn't be analyzed have
+// an error. With KLAR_POLICY every violated rule is a failed testcase
+// instead.
+func junitFormat(w io.Writer, conf *config, results []*scanResult) error {
+	suites := junitTestSuites{Name: "klar"}
+	for _, r := range results {
+		if r.err != nil {
+			suites.add(junitTestSuite{
+				Name:   r.image,
+				Tests:  1,
+				Errors: 1,
+				Cases: []junitTestCase{{
+					ClassName: junitClassName(r.image, "scan"),
+					Name:      "scan",
+					Error:     &junitMessage{Message: r.err.Error()},
+				}},
+			})
+			continue
+		}
+		for _, rep := range r.reports {
+			suites.add(newJUnitTestSuite(conf, rep))
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (s *junitTestSuites) add(suite junitTestSuite) {
+	s.Tests += suite.Tests
+	s.Failures += suite.Failures
+	s.Errors += suite.Errors
+	s.Skipped += suite.Skipped
+	s.Suites = append(s.Suites, suite)
+}
+
+func newJUnitTestSuite(conf *config, rep *report) junitTestSuite {
+	suite := junitTestSuite{Name: rep.Image}
+	if rep.Platform != "" {
+		suite.Name += " " + rep.Platform
+		suite.Properties = append(suite.Properties, junitProperty{Name: "platform", Value: rep.Platform})
+	}
+	if rep.Digest != "" {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "digest", Value: rep.Digest})
+	}
+	for _, v := range rep.Vulnerabilities {
+		tc := newJUnitTestCase(suite.Name, v)
+		if conf.policy == nil && rep.counted(conf, v) {
+			tc.Failure = &junitMessage{
+				Message: junitSummary(v),
+				Type:    v.Severity,
+				Text:    strings.TrimSpace(v.Description + "\n" + v.Link),
+			}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for _, v := range rep.Whitelisted {
+		tc := newJUnitTestCase(suite.Name, v)
+		tc.Skipped = &junitMessage{Message: "Whitelisted: " + junitSummary(v)}
+		suite.Skipped++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	if conf.baseFailed(rep) {
+		suite.Cases = append(suite.Cases, junitTestCase{
+			ClassName: junitClassName(suite.Name, "base"),
+			Name:      "threshold",
+			Failure: &junitMessage{
+				Message: fmt.Sprintf("%d vulnerabilities inherited from %s, %d tolerated", rep.countInherited(conf), conf.base.name, conf.BaseThreshold),
+				Type:    "base",
+			},
+		})
+		suite.Failures++
+	}
+	for _, violation := range rep.Violations {
+		suite.Cases = append(suite.Cases, junitTestCase{
+			ClassName: junitClassName(suite.Name, "policy"),
+			Name:      violation.Rule,
+			Failure: &junitMessage{
+				Message: violation.Message,
+				Type:    "policy",
+				Text:    strings.Join(violation.Vulnerabilities, "\n"),
+			},
+		})
+		suite.Failures++
+	}
+	suite.Tests = len(suite.Cases)
+	return suite
+}
+
+func newJUnitTestCase(suite string, v *clair.Vulnerability) junitTestCase {
+	return junitTestCase{
+		ClassName: junitClassName(suite, v.FeatureName),
+		Name:      v.Name,
+	}
+}
+
+func junitSummary(v *clair.Vulnerability) string {
+	s := fmt.Sprintf("%s: %s in %s %s", v.Severity, v.Name, v.FeatureName, v.FeatureVersion)
+	if v.FixedBy != "" {
+		s += ", fixed by " + v.FixedBy
+	}
+	if v.Instruction != "" {
+		s += ", added by " + v.Instruction
+	}
+	return s
+}
+
+// junitClassName returns image.package class name, dots in the image name
+// are replaced so that test reports show the image as the package
+func junitClassName(image, pkg string) string {
+	return strings.Replace(image, ".", "_", -1) + "." + pkg
+}
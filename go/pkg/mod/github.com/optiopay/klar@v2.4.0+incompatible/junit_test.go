@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+)
+
+func TestJUnitFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := junitFormat(&buf, &config{ClairOutput: "Medium"}, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("Can't decode JUnit XML: %s\n%s", err, buf.String())
+	}
+	if suites.Tests != 4 || suites.Failures != 1 || suites.Skipped != 1 || suites.Errors != 1 {
+		t.Errorf("Unexpected totals %d tests, %d failures, %d skipped, %d errors",
+			suites.Tests, suites.Failures, suites.Skipped, suites.Errors)
+	}
+	if len(suites.Suites) != 2 {
+		t.Fatalf("Expected 2 testsuites, got %d", len(suites.Suites))
+	}
+	cases := suites.Suites[0].Cases
+	expected := []struct {
+		name      string
+		className string
+		failure   bool
+		skipped   bool
+	}{
+		{"CVE-1", "postgres:9_5_1.openssl", true, false},
+		{"CVE-2", "postgres:9_5_1.bash", false, false},
+		{"CVE-3", "postgres:9_5_1.zlib", false, true},
+	}
+	for i, e := range expected {
+		tc := cases[i]
+		if tc.Name != e.name || tc.ClassName != e.className || (tc.Failure != nil) != e.failure || (tc.Skipped != nil) != e.skipped {
+			t.Errorf("Unexpected testcase %+v, expected %+v", tc, e)
+		}
+	}
+
+	// unfixed vulnerabilities pass with IGNORE_UNFIXED
+	buf.Reset()
+	if err := junitFormat(&buf, &config{ClairOutput: "Unknown", IgnoreUnfixed: true}, testResults()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	suites = junitTestSuites{}
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Failures != 1 {
+		t.Errorf("Expected only the fixed vulnerability to fail, got %d failures", suites.Failures)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/optiopay/klar/clair"
@@ -19,12 +23,16 @@ import (
 type vulnerabilitiesWhitelistYAML struct {
 	General []string
 	Images  map[string][]string
+	// Entries are CVEs with details, see whitelistEntryYAML
+	Entries []whitelistEntryYAML
 }
 
-//Map structure used for ease of searching for whitelisted vulnerabilites
+//Entries of every section in the file order, indexed by CVE for searching
 type vulnerabilitiesWhitelist struct {
-	General map[string]bool            //key: CVE and value: true
-	Images  map[string]map[string]bool //key: image name and value: [key: CVE and value: true]
+	Entries []*whitelistEntry
+	byCVE   map[string][]*whitelistEntry //key: CVE
+	// mu guards whitelistEntry.used, images are analysed concurrently
+	mu sync.Mutex
 }
 
 const (
@@ -33,24 +41,47 @@ const (
 	optionKlarTrace        = "KLAR_TRACE"
 	optionClairThreshold   = "CLAIR_THRESHOLD"
 	optionClairTimeout     = "CLAIR_TIMEOUT"
+	optionClairCAFile      = "CLAIR_CA_FILE"
+	optionClairCertFile    = "CLAIR_CERT_FILE"
+	optionClairKeyFile     = "CLAIR_KEY_FILE"
+	optionClairServerName  = "CLAIR_SERVER_NAME"
 	optionDockerTimeout    = "DOCKER_TIMEOUT"
 	optionJSONOutput       = "JSON_OUTPUT" // deprecate?
 	optionFormatOutput     = "FORMAT_OUTPUT"
+	optionFormatTemplate   = "FORMAT_TEMPLATE"
 	optionDockerUser       = "DOCKER_USER"
 	optionDockerPassword   = "DOCKER_PASSWORD"
 	optionDockerToken      = "DOCKER_TOKEN"
 	optionDockerInsecure   = "DOCKER_INSECURE"
 	optionRegistryInsecure = "REGISTRY_INSECURE"
+	optionKlarRegistries   = "KLAR_REGISTRIES"
 	optionWhiteListFile    = "WHITELIST_FILE"
 	optionIgnoreUnfixed    = "IGNORE_UNFIXED"
+	optionKlarPlatform     = "KLAR_PLATFORM"
+	optionKlarServeAddr    = "KLAR_SERVE_ADDR"
+	optionKlarServeURL     = "KLAR_SERVE_URL"
+	optionKlarProxy        = "KLAR_PROXY"
+	optionKlarImagesFrom   = "KLAR_IMAGES_FROM"
+	optionKlarWorkers      = "KLAR_WORKERS"
+	optionKlarJSONVersion  = "KLAR_JSON_VERSION"
+	optionKlarPolicy       = "KLAR_POLICY"
+	optionKlarBaseline     = "KLAR_BASELINE"
+	optionKlarBaselineImg  = "KLAR_BASELINE_IMAGE"
+	optionKlarBaseImage    = "KLAR_BASE_IMAGE"
+	optionKlarBaseThresh   = "KLAR_BASE_THRESHOLD"
+	optionKlarScanTimeout  = "KLAR_SCAN_TIMEOUT"
+	optionKlarRetries      = "KLAR_RETRIES"
+	optionKlarCacheDir     = "KLAR_CACHE_DIR"
+	optionKlarCacheTTL     = "KLAR_CACHE_TTL"
+	optionKlarCacheUpdated = "KLAR_CACHE_CLAIR_UPDATED"
 )
 
 var priorities = []string{"Unknown", "Negligible", "Low", "Medium", "High", "Critical", "Defcon1"}
-var formatTypes = []string{"standard", "json", "table"}
+var formatTypes = []string{"standard", "json", "table", "sarif", "junit", "html", "template"}
 
 func parseOutputPriority() (string, error) {
 	clairOutput := priorities[0]
-	outputEnv := os.Getenv(optionClairOutput)
+	outputEnv := getOption(optionClairOutput)
 	if outputEnv != "" {
 		output := strings.Title(strings.ToLower(outputEnv))
 		correct := false
@@ -71,16 +102,40 @@ func parseOutputPriority() (string, error) {
 
 func parseIntOption(key string) int {
 	val := 0
-	valStr := os.Getenv(key)
+	valStr := getOption(key)
 	if valStr != "" {
 		val, _ = strconv.Atoi(valStr)
 	}
 	return val
 }
 
+// parseDurationOption parses a Go duration, e.g. 90s or 5m. Numbers without
+// a unit are minutes as before durations were supported. Empty value and 0
+// give def, 0 minutes always meant the default.
+func parseDurationOption(key string, def time.Duration) (time.Duration, error) {
+	valStr := getOption(key)
+	if valStr == "" {
+		return def, nil
+	}
+	if minutes, err := strconv.Atoi(valStr); err == nil && minutes >= 0 {
+		if minutes == 0 {
+			return def, nil
+		}
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	val, err := time.ParseDuration(valStr)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("%s %s is not a duration, e.g. 90s or 5m", key, valStr)
+	}
+	if val == 0 {
+		return def, nil
+	}
+	return val, nil
+}
+
 func parseBoolOption(key string) bool {
 	val := false
-	if envVal, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+	if envVal, err := strconv.ParseBool(getOption(key)); err == nil {
 		val = envVal
 	}
 	return val
@@ -92,7 +147,7 @@ func parseFormatTypes() (string, error) {
 		return "json", nil
 	}
 	formatStyle := formatTypes[0]
-	formatOutputEnv := os.Getenv(optionFormatOutput)
+	formatOutputEnv := getOption(optionFormatOutput)
 	if formatOutputEnv != "" {
 		output := strings.ToLower(formatOutputEnv)
 		correct := false
@@ -112,30 +167,95 @@ func parseFormatTypes() (string, error) {
 }
 
 type jsonOutput struct {
+	Platform        string `json:",omitempty"`
+	Digest          string `json:",omitempty"`
 	LayerCount      int
 	Vulnerabilities map[string][]*clair.Vulnerability
 }
 
+// platformsJSONOutput is the JSON report for all platforms of a multi-arch image
+type platformsJSONOutput struct {
+	Platforms []jsonOutput
+}
+
+// imagesJSONOutput is the JSON report when several images are scanned
+type imagesJSONOutput struct {
+	Images []imageJSONOutput
+}
+
+type imageJSONOutput struct {
+	Image     string
+	Error     string `json:",omitempty"`
+	Platforms []jsonOutput
+}
+
+// defaultWorkers is the number of images scanned at the same time
+const defaultWorkers = 4
+
+// defaultTimeout is the default of CLAIR_TIMEOUT and DOCKER_TIMEOUT
+const defaultTimeout = time.Minute
+
 type config struct {
-	ClairAddr     string
-	ClairOutput   string
-	Threshold     int
-	JSONOutput    bool
-	FormatStyle   string
-	ClairTimeout  time.Duration
+	ClairAddr    string
+	ClairOutput  string
+	Threshold    int
+	JSONOutput   bool
+	FormatStyle  string
+	ClairTimeout time.Duration
+	// ClairTLS secures the connection to Clair, nil if no CLAIR_CA_FILE,
+	// CLAIR_CERT_FILE, CLAIR_KEY_FILE or CLAIR_SERVER_NAME is set
+	ClairTLS *tls.Config
+	// ScanTimeout is the deadline of the whole scan, 0 if there is none
+	ScanTimeout time.Duration
+	// Retries is the number of times failed requests are repeated,
+	// negative if they aren't
+	Retries       int
 	DockerConfig  docker.Config
 	WhiteListFile string
 	IgnoreUnfixed bool
+	AllPlatforms  bool
+	// Images are scanned with DockerConfig, ImageName is set per image
+	Images  []string
+	Workers int
+	// JSONVersion is the JSON report schema version, 1 is the format
+	// before the versioned report
+	JSONVersion int
+	// template is the parsed FORMAT_TEMPLATE for the template format
+	template *template.Template
+	// policy is the parsed KLAR_POLICY, it replaces Threshold if set
+	policy *policy
+	// BaselineImage is scanned to set baseline before the images
+	BaselineImage string
+	// baseline is set with KLAR_BASELINE or KLAR_BASELINE_IMAGE, the
+	// threshold and the policy apply only to vulnerabilities not in it
+	baseline *baseline
+	// BaseImage is pulled to split vulnerabilities into inherited from it
+	// and introduced by the scanned image, the threshold and the policy
+	// apply only to introduced ones
+	BaseImage string
+	// BaseThreshold is the number of inherited vulnerabilities tolerated,
+	// -1 if they never fail the scan
+	BaseThreshold int
+	// base is set after BaseImage is pulled
+	base *baseImage
+	// cache is set with KLAR_CACHE_DIR, images found in it aren't sent
+	// to Clair
+	cache *resultCache
+	// ctx carries the ScanTimeout deadline, it is set by main
+	ctx context.Context
 }
 
-func newConfig(args []string) (*config, error) {
-	clairAddr := os.Getenv(optionClairAddress)
+func newConfig(images []string) (*config, error) {
+	clairAddr := getOption(optionClairAddress)
 	if clairAddr == "" {
 		return nil, fmt.Errorf("Clair address must be provided\n")
 	}
 
-	if os.Getenv(optionKlarTrace) != "" {
-		utils.Trace = true
+	if trace := getOption(optionKlarTrace); trace != "" {
+		// any value but false enables tracing, as before --trace existed
+		if enabled, err := strconv.ParseBool(trace); err != nil || enabled {
+			utils.Trace = true
+		}
 	}
 
 	clairOutput, err := parseOutputPriority()
@@ -143,14 +263,41 @@ func newConfig(args []string) (*config, error) {
 		return nil, err
 	}
 
-	clairTimeout := parseIntOption(optionClairTimeout)
-	if clairTimeout == 0 {
-		clairTimeout = 1
+	clairTimeout, err := parseDurationOption(optionClairTimeout, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dockerTimeout, err := parseDurationOption(optionDockerTimeout, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	scanTimeout, err := parseDurationOption(optionKlarScanTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	clairTLS, err := clair.LoadTLSConfig(getOption(optionClairCAFile), getOption(optionClairCertFile),
+		getOption(optionClairKeyFile), getOption(optionClairServerName))
+	if err != nil {
+		return nil, fmt.Errorf("%s\n", err)
 	}
 
-	dockerTimeout := parseIntOption(optionDockerTimeout)
-	if dockerTimeout == 0 {
-		dockerTimeout = 1
+	// 0 means the default of docker and clair packages, negative disables retries
+	retries := 0
+	if v := getOption(optionKlarRetries); v != "" {
+		if retries, err = strconv.Atoi(v); err != nil || retries < 0 {
+			return nil, fmt.Errorf("Number of retries %s is not supported", v)
+		}
+		if retries == 0 {
+			retries = -1
+		}
+	}
+
+	var registries map[string]docker.RegistryConfig
+	if path := getOption(optionKlarRegistries); path != "" {
+		if registries, err = parseRegistriesFile(path); err != nil {
+			return nil, fmt.Errorf("%s\n", err)
+		}
 	}
 
 	formatStyle, err := parseFormatTypes()
@@ -158,6 +305,89 @@ func newConfig(args []string) (*config, error) {
 		return nil, err
 	}
 
+	var tmpl *template.Template
+	if formatStyle == "template" {
+		path := getOption(optionFormatTemplate)
+		if path == "" {
+			return nil, fmt.Errorf("Template format requires %s\n", optionFormatTemplate)
+		}
+		if tmpl, err = parseTemplate(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := getOption(optionKlarImagesFrom); path != "" {
+		listed, err := readImageList(path)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, listed...)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("Image name must be provided\n")
+	}
+
+	var pol *policy
+	if path := getOption(optionKlarPolicy); path != "" {
+		if pol, err = parsePolicyFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var base *baseline
+	baselineImage := getOption(optionKlarBaselineImg)
+	if path := getOption(optionKlarBaseline); path != "" {
+		if baselineImage != "" {
+			return nil, fmt.Errorf("Only one of %s and %s can be set\n", optionKlarBaseline, optionKlarBaselineImg)
+		}
+		if base, err = parseBaselineFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	baseImage := getOption(optionKlarBaseImage)
+	baseThreshold := -1
+	if v := getOption(optionKlarBaseThresh); v != "" {
+		if baseImage == "" {
+			return nil, fmt.Errorf("%s requires %s\n", optionKlarBaseThresh, optionKlarBaseImage)
+		}
+		if baseThreshold, err = strconv.Atoi(v); err != nil || baseThreshold < 0 {
+			return nil, fmt.Errorf("Base threshold %s is not a number of vulnerabilities\n", v)
+		}
+	}
+
+	var cache *resultCache
+	if dir := getOption(optionKlarCacheDir); dir != "" {
+		cache = &resultCache{dir: dir}
+		if cache.ttl, err = parseDurationOption(optionKlarCacheTTL, defaultCacheTTL); err != nil {
+			return nil, err
+		}
+		if v := getOption(optionKlarCacheUpdated); v != "" {
+			if cache.clairUpdated, err = parseClairUpdated(v); err != nil {
+				return nil, fmt.Errorf("%s\n", err)
+			}
+		}
+	}
+
+	jsonVersion := jsonReportVersion
+	if v := getOption(optionKlarJSONVersion); v != "" {
+		if jsonVersion, err = strconv.Atoi(v); err != nil || jsonVersion < 1 || jsonVersion > jsonReportVersion {
+			return nil, fmt.Errorf("JSON report version %s is not supported, only 1 and %d", v, jsonReportVersion)
+		}
+	}
+
+	workers := parseIntOption(optionKlarWorkers)
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	// KLAR_PLATFORM=all scans every platform of a manifest list
+	platform := getOption(optionKlarPlatform)
+	allPlatforms := strings.ToLower(platform) == "all"
+	if allPlatforms {
+		platform = ""
+	}
+
 	return &config{
 		ClairAddr:     clairAddr,
 		ClairOutput:   clairOutput,
@@ -165,24 +395,62 @@ func newConfig(args []string) (*config, error) {
 		JSONOutput:    formatStyle == "json",
 		FormatStyle:   formatStyle,
 		IgnoreUnfixed: parseBoolOption(optionIgnoreUnfixed),
-		ClairTimeout:  time.Duration(clairTimeout) * time.Minute,
-		WhiteListFile: os.Getenv(optionWhiteListFile),
+		AllPlatforms:  allPlatforms,
+		ClairTimeout:  clairTimeout,
+		ClairTLS:      clairTLS,
+		ScanTimeout:   scanTimeout,
+		Retries:       retries,
+		WhiteListFile: getOption(optionWhiteListFile),
+		Images:        images,
+		Workers:       workers,
+		JSONVersion:   jsonVersion,
+		template:      tmpl,
+		policy:        pol,
+		BaselineImage: baselineImage,
+		baseline:      base,
+		BaseImage:     baseImage,
+		BaseThreshold: baseThreshold,
+		cache:         cache,
 		DockerConfig: docker.Config{
-			ImageName:        args[1],
-			User:             os.Getenv(optionDockerUser),
-			Password:         os.Getenv(optionDockerPassword),
-			Token:            os.Getenv(optionDockerToken),
+			User:             getOption(optionDockerUser),
+			Password:         getOption(optionDockerPassword),
+			Token:            getOption(optionDockerToken),
 			InsecureTLS:      parseBoolOption(optionDockerInsecure),
 			InsecureRegistry: parseBoolOption(optionRegistryInsecure),
-			Timeout:          time.Duration(dockerTimeout) * time.Minute,
+			Timeout:          dockerTimeout,
+			Retries:          retries,
+			Platform:         platform,
+			ServeAddr:        getOption(optionKlarServeAddr),
+			ServeURL:         getOption(optionKlarServeURL),
+			Proxy:            parseBoolOption(optionKlarProxy),
+			ConfigDir:        getOption(optionDockerConfig),
+			DockerHost:       getOption(optionDockerHost),
+			Registries:       registries,
 		},
 	}, nil
 }
 
+// readImageList reads image names from a file, one per line.
+// Empty lines and lines starting with # are skipped.
+func readImageList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image list %v", err)
+	}
+	var images []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, nil
+}
+
 //Parse the whitelist file
 func parseWhitelistFile(whitelistFile string) (*vulnerabilitiesWhitelist, error) {
 	whitelistYAML := vulnerabilitiesWhitelistYAML{}
-	whitelist := vulnerabilitiesWhitelist{}
 
 	//read the whitelist file
 	whitelistBytes, err := ioutil.ReadFile(whitelistFile)
@@ -192,22 +460,40 @@ func parseWhitelistFile(whitelistFile string) (*vulnerabilitiesWhitelist, error)
 	if err = yaml.Unmarshal(whitelistBytes, &whitelistYAML); err != nil {
 		return nil, fmt.Errorf("could not unmarshal %v", err)
 	}
+	return newWhitelist(whitelistYAML)
+}
 
-	//Initialize the whitelist maps
-	whitelist.General = make(map[string]bool)
-	whitelist.Images = make(map[string]map[string]bool)
+//Build the whitelist from all sections of the file
+func newWhitelist(whitelistYAML vulnerabilitiesWhitelistYAML) (*vulnerabilitiesWhitelist, error) {
+	whitelist := &vulnerabilitiesWhitelist{byCVE: make(map[string][]*whitelistEntry)}
+	add := func(e *whitelistEntry) {
+		whitelist.Entries = append(whitelist.Entries, e)
+		whitelist.byCVE[e.CVE] = append(whitelist.byCVE[e.CVE], e)
+	}
 
-	//Populate the maps
 	for _, cve := range whitelistYAML.General {
-		whitelist.General[cve] = true
+		add(&whitelistEntry{CVE: cve})
+	}
+
+	//image keys are matched as patterns too, images are sorted to keep the file order stable
+	images := make([]string, 0, len(whitelistYAML.Images))
+	for image := range whitelistYAML.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		for _, cve := range whitelistYAML.Images[image] {
+			add(&whitelistEntry{CVE: cve, Images: []string{image}})
+		}
 	}
 
-	for image, cveList := range whitelistYAML.Images {
-		whitelist.Images[image] = make(map[string]bool)
-		for _, cve := range cveList {
-			whitelist.Images[image][cve] = true
+	for i, y := range whitelistYAML.Entries {
+		e, err := newWhitelistEntry(y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %d: %v", i+1, err)
 		}
+		add(e)
 	}
 
-	return &whitelist, nil
+	return whitelist, nil
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseIntOption(t *testing.T) {
@@ -35,6 +39,38 @@ func TestParseIntOption(t *testing.T) {
 	}
 }
 
+func TestParseDurationOption(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{value: "", expected: time.Minute},
+		{value: "3", expected: 3 * time.Minute},
+		{value: "90s", expected: 90 * time.Second},
+		{value: "1h30m", expected: 90 * time.Minute},
+		// 0 is the default as before durations were supported
+		{value: "0", expected: time.Minute},
+		{value: "0s", expected: time.Minute},
+		{value: "-5s", err: true},
+		{value: "x", err: true},
+	}
+	for _, tc := range cases {
+		os.Setenv(optionClairTimeout, tc.value)
+		got, err := parseDurationOption(optionClairTimeout, time.Minute)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.value)
+			}
+			continue
+		}
+		if err != nil || got != tc.expected {
+			t.Errorf("%q: expected %s got %s, %v", tc.value, tc.expected, got, err)
+		}
+	}
+	os.Unsetenv(optionClairTimeout)
+}
+
 func TestParseBoolOption(t *testing.T) {
 	cases := []struct {
 		value    string
@@ -96,3 +132,24 @@ func TestParseOutputPriority(t *testing.T) {
 		}
 	}
 }
+
+func TestReadImageList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "images.txt")
+	list := "# nightly audit\npostgres:9.5.1\n\n  registry:5000/team/app:1.0  \n"
+	if err := ioutil.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images, err := readImageList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"postgres:9.5.1", "registry:5000/team/app:1.0"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected %v got %v", expected, images)
+	}
+}
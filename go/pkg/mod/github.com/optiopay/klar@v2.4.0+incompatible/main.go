@@ -1,26 +1,43 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/optiopay/klar/clair"
 	"github.com/optiopay/klar/docker"
 )
 
-var store = make(map[string][]*clair.Vulnerability)
-
 func main() {
 	fail := func(format string, a ...interface{}) {
 		fmt.Fprintf(os.Stderr, fmt.Sprintf("%s\n", format), a...)
 		os.Exit(2)
 	}
 
-	if len(os.Args) != 2 {
-		fail("Image name must be provided")
+	cmd, err := parseCommandLine(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+	switch cmd.name {
+	case "version":
+		fmt.Println(version)
+		return
+	case "config print":
+		if err := printConfig(os.Stdout); err != nil {
+			fail("Can't print config: %s", err)
+		}
+		return
 	}
 
-	conf, err := newConfig(os.Args)
+	conf, err := newConfig(cmd.args)
 	if err != nil {
 		fail("Invalid options: %s", err)
 	}
@@ -28,7 +45,17 @@ func main() {
 	if !conf.JSONOutput {
 		fmt.Fprintf(os.Stderr, "clair timeout %s\n", conf.ClairTimeout)
 		fmt.Fprintf(os.Stderr, "docker timeout: %s\n", conf.DockerConfig.Timeout)
+		if conf.ScanTimeout > 0 {
+			fmt.Fprintf(os.Stderr, "scan timeout: %s\n", conf.ScanTimeout)
+		}
+	}
+	conf.ctx = context.Background()
+	if conf.ScanTimeout > 0 {
+		var cancel context.CancelFunc
+		conf.ctx, cancel = context.WithTimeout(conf.ctx, conf.ScanTimeout)
+		defer cancel()
 	}
+	conf.DockerConfig.Context = conf.ctx
 	whitelist := &vulnerabilitiesWhitelist{}
 	if conf.WhiteListFile != "" {
 		if !conf.JSONOutput {
@@ -38,86 +65,179 @@ func main() {
 		if err != nil {
 			fail("Could not parse whitelist file: %s", err)
 		}
+		for _, e := range whitelist.expire(time.Now()) {
+			fmt.Fprintf(os.Stderr, "Warning: whitelist entry %s expired on %s\n", e, e.Expires.Format(whitelistExpiresLayout))
+		}
 	} else {
 		if !conf.JSONOutput {
 			fmt.Fprintf(os.Stderr, "no whitelist file\n")
 		}
 	}
 
-	image, err := docker.NewImage(&conf.DockerConfig)
-	if err != nil {
-		fail("Can't parse qname: %s", err)
+	if conf.BaseImage != "" {
+		if !conf.JSONOutput {
+			fmt.Fprintf(os.Stderr, "base image: %s\n", conf.BaseImage)
+		}
+		if conf.base, err = pullBaseImage(conf); err != nil {
+			fail("Could not pull base image: %s", conf.scanError("pulling base image", err))
+		}
 	}
 
-	err = image.Pull()
-	if err != nil {
-		fail("Can't pull image: %s", err)
+	if conf.BaselineImage != "" {
+		if !conf.JSONOutput {
+			fmt.Fprintf(os.Stderr, "baseline image: %s\n", conf.BaselineImage)
+		}
+		if conf.baseline, err = scanBaselineImage(conf); err != nil {
+			fail("Could not scan baseline image: %s", err)
+		}
 	}
 
-	output := jsonOutput{
-		Vulnerabilities: make(map[string][]*clair.Vulnerability),
+	results := scanImages(conf, whitelist)
+	multiImage := len(results) > 1
+	imagesOutput := imagesJSONOutput{}
+	for _, r := range results {
+		<-r.done
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", r.image, r.err)
+		}
+		switch {
+		case conf.legacyJSON() && multiImage:
+			out := imageJSONOutput{Image: r.image, Platforms: r.outputs}
+			if r.err != nil {
+				out.Error = r.err.Error()
+			}
+			imagesOutput.Images = append(imagesOutput.Images, out)
+		case conf.legacyJSON() && r.err == nil:
+			enc := json.NewEncoder(os.Stdout)
+			if len(r.outputs) > 1 {
+				enc.Encode(platformsJSONOutput{Platforms: r.outputs})
+			} else {
+				enc.Encode(r.outputs[0])
+			}
+		case conf.textOutput():
+			if multiImage {
+				fmt.Printf("Image %s\n", r.image)
+			}
+			r.report.WriteTo(os.Stdout)
+			if multiImage {
+				fmt.Println()
+			}
+		}
+	}
+	if conf.legacyJSON() && multiImage {
+		enc := json.NewEncoder(os.Stdout)
+		enc.Encode(imagesOutput)
+	}
+	if unused := whitelist.unused(); len(unused) > 0 {
+		fmt.Fprintf(os.Stderr, "Unused whitelist entries:\n")
+		for _, e := range unused {
+			fmt.Fprintf(os.Stderr, "  %s\n", e)
+		}
+	}
+	if format, ok := documentFormats[conf.FormatStyle]; ok && !conf.legacyJSON() {
+		if err := format(os.Stdout, conf, results); err != nil {
+			fail("Can't write %s report: %s", conf.FormatStyle, err)
+		}
 	}
 
+	os.Exit(exitCode(results))
+}
+
+// analyse sends image layers to Clair, writes the text report to w and
+// returns the report of the image and the number of vulnerabilities which
+// count towards the threshold
+func analyse(conf *config, whitelist *vulnerabilitiesWhitelist, name string, image *docker.Image, w io.Writer) (*report, int, error) {
 	if len(image.FsLayers) == 0 {
-		fail("Can't pull fsLayers")
-	} else {
-		if conf.JSONOutput {
-			output.LayerCount = len(image.FsLayers)
-		} else {
-			fmt.Printf("Analysing %d layers\n", len(image.FsLayers))
-		}
+		return nil, 0, fmt.Errorf("Can't pull fsLayers")
+	}
+	rep := &report{
+		Image:      name,
+		Repository: image.Name,
+		Tag:        image.Tag,
+		LayerCount: len(image.FsLayers),
+		ScanTime:   time.Now().UTC(),
+	}
+	if conf.textOutput() {
+		fmt.Fprintf(w, "Analysing %d layers\n", len(image.FsLayers))
 	}
 
 	var vs []*clair.Vulnerability
+	var err error
+	if conf.cache != nil && image.Digest != "" {
+		if e := conf.cache.get(conf.ClairAddr, image.Digest, time.Now()); e != nil {
+			clair.FilterEmptyLayers(image)
+			vs, rep.ClairAPIVersion, rep.ScanTime, rep.Cached = e.Vulnerabilities, e.ClairAPIVersion, e.Created, true
+			if conf.textOutput() {
+				fmt.Fprintf(w, "Got cached results from Clair API v%d of %s\n", e.ClairAPIVersion, e.Created.Format(time.RFC3339))
+			}
+		}
+	}
 	for _, ver := range []int{1, 3} {
-		c := clair.NewClair(conf.ClairAddr, ver, conf.ClairTimeout)
+		if rep.Cached {
+			break
+		}
+		c := clair.NewClairWithConfig(conf.ClairAddr, ver, &clair.Config{
+			Timeout: conf.ClairTimeout,
+			Retries: conf.Retries,
+			Context: conf.ctx,
+			TLS:     conf.ClairTLS,
+		})
 		vs, err = c.Analyse(image)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to analyze using API v%d: %s\n", ver, err)
+			fmt.Fprintf(os.Stderr, "Failed to analyze %s using API v%d: %s\n", image.Name, ver, err)
 		} else {
-			if !conf.JSONOutput {
-				fmt.Printf("Got results from Clair API v%d\n", ver)
+			if conf.textOutput() {
+				fmt.Fprintf(w, "Got results from Clair API v%d\n", ver)
 			}
+			rep.ClairAPIVersion = ver
 			break
 		}
 	}
 	if err != nil {
-		fail("Failed to analyze, exiting")
+		return nil, 0, fmt.Errorf("Failed to analyze: %s", conf.scanError("analyzing image with Clair", err))
 	}
-
-	vsNumber := 0
-
-	numVulnerabilites := len(vs)
-	vs = filterWhitelist(whitelist, vs, image.Name)
-	numVulnerabilitiesAfterWhitelist := len(vs)
-	groupBySeverity(vs)
-
-	if conf.JSONOutput {
-		vsNumber = jsonFormat(conf, output)
-	} else {
-		if numVulnerabilitiesAfterWhitelist < numVulnerabilites {
-			//display how many vulnerabilities were whitelisted
-			fmt.Printf("Whitelisted %d vulnerabilities\n", numVulnerabilites-numVulnerabilitiesAfterWhitelist)
+	if conf.cache != nil && image.Digest != "" && !rep.Cached {
+		if err := conf.cache.put(conf.ClairAddr, image.Digest, rep.ClairAPIVersion, vs, rep.ScanTime); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't cache results of %s: %s\n", image.Digest, err)
 		}
-		fmt.Printf("Found %d vulnerabilities\n", len(vs))
-		switch style := conf.FormatStyle; style {
-		case "table":
-			vsNumber = tableFormat(conf, vs)
-		default:
-			vsNumber = standardFormat(conf, vs)
+	}
+
+	rep.setLayers(image)
+	ref := imageRef{repository: image.Name, tag: image.Tag}
+	if !image.IsLocal() {
+		if parsed, err := docker.ParseReference(name); err == nil {
+			rep.Registry = parsed.Domain
+			ref.registry = parsed.Domain
 		}
 	}
+	rep.Vulnerabilities, rep.Whitelisted, rep.whitelistedBy = partitionWhitelist(whitelist, vs, ref)
+	if !conf.textOutput() {
+		return rep, rep.countVulnerabilities(conf), nil
+	}
 
-	if vsNumber > conf.Threshold {
-		os.Exit(1)
+	vsNumber := 0
+	store := groupBySeverity(rep.Vulnerabilities)
+	if len(rep.Whitelisted) > 0 {
+		//display how many vulnerabilities were whitelisted
+		fmt.Fprintf(w, "Whitelisted %d vulnerabilities\n", len(rep.Whitelisted))
+	}
+	fmt.Fprintf(w, "Found %d vulnerabilities\n", len(rep.Vulnerabilities))
+	switch style := conf.FormatStyle; style {
+	case "table":
+		vsNumber = tableFormat(w, conf, store)
+	default:
+		vsNumber = standardFormat(w, conf, store)
 	}
+	return rep, vsNumber, nil
 }
 
-func groupBySeverity(vs []*clair.Vulnerability) {
+func groupBySeverity(vs []*clair.Vulnerability) map[string][]*clair.Vulnerability {
+	store := make(map[string][]*clair.Vulnerability)
 	for _, v := range vs {
 		sevRow := vulnsBy(v.Severity, store)
 		store[v.Severity] = append(sevRow, v)
 	}
+	return store
 }
 
 func vulnsBy(sev string, store map[string][]*clair.Vulnerability) []*clair.Vulnerability {
@@ -130,20 +250,28 @@ func vulnsBy(sev string, store map[string][]*clair.Vulnerability) []*clair.Vulne
 }
 
 //Filter out whitelisted vulnerabilites
-func filterWhitelist(whitelist *vulnerabilitiesWhitelist, vs []*clair.Vulnerability, imageName string) []*clair.Vulnerability {
-	generalWhitelist := whitelist.General
-	imageWhitelist := whitelist.Images
+func filterWhitelist(whitelist *vulnerabilitiesWhitelist, vs []*clair.Vulnerability, image imageRef) []*clair.Vulnerability {
+	filteredVs, _, _ := partitionWhitelist(whitelist, vs, image)
+	return filteredVs
+}
 
+// partitionWhitelist splits vulnerabilities into not whitelisted and whitelisted
+// ones and maps the latter to the entries excluding them
+func partitionWhitelist(whitelist *vulnerabilitiesWhitelist, vs []*clair.Vulnerability, image imageRef) ([]*clair.Vulnerability, []*clair.Vulnerability, map[*clair.Vulnerability]*whitelistEntry) {
 	filteredVs := make([]*clair.Vulnerability, 0, len(vs))
+	var whitelistedVs []*clair.Vulnerability
+	entries := make(map[*clair.Vulnerability]*whitelistEntry)
 
 	for _, v := range vs {
-		if _, exists := generalWhitelist[v.Name]; !exists {
-			if _, exists := imageWhitelist[imageName][v.Name]; !exists {
-				//vulnerability is not in the image whitelist, so add it to the list to return
-				filteredVs = append(filteredVs, v)
-			}
+		e := whitelist.match(v, image)
+		if e == nil {
+			//vulnerability is not whitelisted, so add it to the list to return
+			filteredVs = append(filteredVs, v)
+			continue
 		}
+		whitelistedVs = append(whitelistedVs, v)
+		entries[v] = e
 	}
 
-	return filteredVs
+	return filteredVs, whitelistedVs, entries
 }
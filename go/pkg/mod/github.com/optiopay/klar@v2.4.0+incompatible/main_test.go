@@ -9,10 +9,13 @@ import (
 )
 
 func TestFilterWhitelist(t *testing.T) {
-	image := "fluent/fluent-bit"
-	whitelist := &vulnerabilitiesWhitelist{
-		map[string]bool{"CVE-3": true},
-		map[string]map[string]bool{image: {"CVE-4": true}},
+	image := imageRef{repository: "fluent/fluent-bit", tag: "1.0"}
+	whitelist, err := newWhitelist(vulnerabilitiesWhitelistYAML{
+		General: []string{"CVE-3"},
+		Images:  map[string][]string{"fluent/fluent-bit": {"CVE-4"}},
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	vs := make([]*clair.Vulnerability, 5)
@@ -27,10 +30,10 @@ func TestFilterWhitelist(t *testing.T) {
 
 	filtered := filterWhitelist(whitelist, vs, image)
 	if !reflect.DeepEqual(filtered, expected) {
-		t.Fatalf("Actual filtered vulnerabilities %s did not match expected ones %s.", filtered, expected)
+		t.Fatalf("Actual filtered vulnerabilities %v did not match expected ones %v.", filtered, expected)
 	}
 
 }
 func mockVulnerability(name string) *clair.Vulnerability {
-	return &clair.Vulnerability{name, "", "", "", "", nil, "", nil, "", ""}
+	return &clair.Vulnerability{Name: name}
 }
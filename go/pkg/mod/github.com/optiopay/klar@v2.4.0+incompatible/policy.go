@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+
+	"gopkg.in/yaml.v2"
+)
+
+// policy is the KLAR_POLICY file, it replaces CLAIR_THRESHOLD and
+// IGNORE_UNFIXED. Rules apply to vulnerabilities which are not whitelisted,
+// whatever CLAIR_OUTPUT is.
+//
+//	severities:
+//	  Critical: 0
+//	  High: 3
+//	max-cvss: 7.0
+//	fixable-only: true
+//	max-fixable-age-days: 30
+//	packages:
+//	  allow: [bash]
+//	  deny: [openssl*]
+type policy struct {
+	// Severities is the maximum number of vulnerabilities per severity
+	Severities map[string]int `yaml:"severities"`
+	// MaxCVSS is the highest tolerated NVD CVSS score, 0 disables the rule
+	MaxCVSS float64 `yaml:"max-cvss"`
+	// FixableOnly limits all rules to vulnerabilities with a fix
+	FixableOnly bool `yaml:"fixable-only"`
+	// MaxFixableAgeDays is the number of days a vulnerability with a fix
+	// may be known since NVD published it, 0 disables the rule
+	MaxFixableAgeDays int            `yaml:"max-fixable-age-days"`
+	Packages          policyPackages `yaml:"packages"`
+}
+
+// policyPackages are package name patterns as in path.Match
+type policyPackages struct {
+	// Allow excludes vulnerabilities of the packages from all rules
+	Allow []string `yaml:"allow"`
+	// Deny fails on any vulnerability of the packages
+	Deny []string `yaml:"deny"`
+}
+
+// policyViolation is a rule the image doesn't comply with
+type policyViolation struct {
+	Rule            string   `json:"rule"`
+	Message         string   `json:"message"`
+	Vulnerabilities []string `json:"vulnerabilities"`
+}
+
+// nvdTimeLayouts are layouts of PublishedDateTime in Clair NVD metadata
+var nvdTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02T15:04Z"}
+
+// parsePolicyFile reads and validates the KLAR_POLICY file
+func parsePolicyFile(file string) (*policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read policy file: %s", err)
+	}
+	p := &policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("Can't decode policy file %s: %s", file, err)
+	}
+	severities := make(map[string]int, len(p.Severities))
+	for sev, max := range p.Severities {
+		name := strings.Title(strings.ToLower(sev))
+		if severityIndex(name) == -1 {
+			return nil, fmt.Errorf("Unknown severity %s in policy file %s, only %v are supported", sev, file, priorities)
+		}
+		severities[name] = max
+	}
+	p.Severities = severities
+	for _, pattern := range append(p.Packages.Allow, p.Packages.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Bad package pattern %s in policy file %s: %s", pattern, file, err)
+		}
+	}
+	return p, nil
+}
+
+func matchPackage(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate returns the rules vulnerabilities violate, the age of
+// fixable vulnerabilities is computed at now
+func (p *policy) evaluate(vs []*clair.Vulnerability, now time.Time) []policyViolation {
+	var checked []*clair.Vulnerability
+	for _, v := range vs {
+		if p.FixableOnly && v.FixedBy == "" {
+			continue
+		}
+		if matchPackage(p.Packages.Allow, v.FeatureName) {
+			continue
+		}
+		checked = append(checked, v)
+	}
+
+	var violations []policyViolation
+	bySeverity := groupBySeverity(checked)
+	for i := len(priorities) - 1; i >= 0; i-- {
+		sev := priorities[i]
+		max, ok := p.Severities[sev]
+		if !ok || len(bySeverity[sev]) <= max {
+			continue
+		}
+		violations = append(violations, policyViolation{
+			Rule:            "severities",
+			Message:         fmt.Sprintf("%d %s vulnerabilities, maximum is %d", len(bySeverity[sev]), sev, max),
+			Vulnerabilities: vulnerabilityNames(bySeverity[sev]),
+		})
+	}
+
+	for _, v := range checked {
+		if score, ok := cvssScore(v); ok && p.MaxCVSS > 0 && score > p.MaxCVSS {
+			violations = append(violations, policyViolation{
+				Rule:            "max-cvss",
+				Message:         fmt.Sprintf("%s in %s %s has CVSS score %.1f, maximum is %.1f", v.Name, v.FeatureName, v.FeatureVersion, score, p.MaxCVSS),
+				Vulnerabilities: []string{v.Name},
+			})
+		}
+	}
+
+	for _, v := range checked {
+		published, ok := nvdPublished(v)
+		if !ok || p.MaxFixableAgeDays <= 0 || v.FixedBy == "" {
+			continue
+		}
+		if days := int(now.Sub(published).Hours() / 24); days > p.MaxFixableAgeDays {
+			violations = append(violations, policyViolation{
+				Rule:            "max-fixable-age-days",
+				Message:         fmt.Sprintf("%s in %s %s has been fixable in %s for %d days, maximum is %d", v.Name, v.FeatureName, v.FeatureVersion, v.FixedBy, days, p.MaxFixableAgeDays),
+				Vulnerabilities: []string{v.Name},
+			})
+		}
+	}
+
+	for _, v := range checked {
+		if matchPackage(p.Packages.Deny, v.FeatureName) {
+			violations = append(violations, policyViolation{
+				Rule:            "packages",
+				Message:         fmt.Sprintf("%s in %s %s, the package is denied", v.Name, v.FeatureName, v.FeatureVersion),
+				Vulnerabilities: []string{v.Name},
+			})
+		}
+	}
+	return violations
+}
+
+func vulnerabilityNames(vs []*clair.Vulnerability) []string {
+	names := make([]string, len(vs))
+	for i, v := range vs {
+		names[i] = v.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nvdMetadata returns the NVD part of Clair vulnerability metadata
+func nvdMetadata(v *clair.Vulnerability) map[string]interface{} {
+	nvd, _ := v.Metadata["NVD"].(map[string]interface{})
+	return nvd
+}
+
+// cvssScore returns the NVD CVSSv3 base score, or the CVSSv2 one
+// if Clair doesn't have the former
+func cvssScore(v *clair.Vulnerability) (float64, bool) {
+	nvd := nvdMetadata(v)
+	for _, key := range []string{"CVSSv3", "CVSSv2"} {
+		cvss, _ := nvd[key].(map[string]interface{})
+		switch score := cvss["Score"].(type) {
+		case float64:
+			if score > 0 {
+				return score, true
+			}
+		case string:
+			if f, err := strconv.ParseFloat(score, 64); err == nil && f > 0 {
+				return f, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// nvdPublished returns when NVD published the vulnerability
+func nvdPublished(v *clair.Vulnerability) (time.Time, bool) {
+	published, _ := nvdMetadata(v)["PublishedDateTime"].(string)
+	for _, layout := range nvdTimeLayouts {
+		if t, err := time.Parse(layout, published); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// writeViolations writes violated policy rules in the text report
+func writeViolations(w io.Writer, violations []policyViolation) {
+	if len(violations) == 0 {
+		fmt.Fprintf(w, "Policy passed\n")
+		return
+	}
+	fmt.Fprintf(w, "Policy violations:\n")
+	for _, v := range violations {
+		fmt.Fprintf(w, "  %s: %s\n", v.Rule, v.Message)
+	}
+}
+
+// failed reports whether the image doesn't pass KLAR_POLICY or, without
+// a policy, is over CLAIR_THRESHOLD
+func (conf *config) failed(rep *report) bool {
+	if conf.baseFailed(rep) {
+		return true
+	}
+	if conf.policy != nil {
+		return len(rep.Violations) > 0
+	}
+	return rep.countVulnerabilities(conf) > conf.Threshold
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+func TestParsePolicyFile(t *testing.T) {
+	p, err := parsePolicyFile("policy-example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &policy{
+		Severities:        map[string]int{"Critical": 0, "High": 3},
+		MaxCVSS:           8.9,
+		FixableOnly:       true,
+		MaxFixableAgeDays: 90,
+		Packages:          policyPackages{Allow: []string{"linux-libc-dev"}, Deny: []string{"openssl*"}},
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("expected %+v got %+v", expected, p)
+	}
+
+	dir, err := ioutil.TempDir("", "klar-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, bad := range []string{
+		"severities:\n  Severe: 1\n",
+		"max_cvss: 7\n",
+		"packages:\n  deny: ['[']\n",
+	} {
+		path := filepath.Join(dir, "policy.yaml")
+		if err := ioutil.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePolicyFile(path); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	nvd := func(score float64, published string) map[string]interface{} {
+		return map[string]interface{}{"NVD": map[string]interface{}{
+			"CVSSv2":            map[string]interface{}{"Score": score},
+			"PublishedDateTime": published,
+		}}
+	}
+	vs := []*clair.Vulnerability{
+		{Name: "CVE-1", Severity: "Critical", FeatureName: "openssl", FeatureVersion: "1.0", FixedBy: "1.1", Metadata: nvd(9.8, "2019-05-20T10:29Z")},
+		{Name: "CVE-2", Severity: "High", FeatureName: "bash", FeatureVersion: "4.3", FixedBy: "4.4", Metadata: nvd(7.5, "2018-01-01T00:00Z")},
+		{Name: "CVE-3", Severity: "High", FeatureName: "curl", FixedBy: "7.6"},
+		{Name: "CVE-4", Severity: "Critical", FeatureName: "zlib"},
+		{Name: "CVE-5", Severity: "Critical", FeatureName: "linux-libc-dev", FixedBy: "4.9"},
+	}
+	p := &policy{
+		Severities:        map[string]int{"Critical": 0, "High": 1},
+		MaxCVSS:           9,
+		FixableOnly:       true,
+		MaxFixableAgeDays: 30,
+		Packages:          policyPackages{Allow: []string{"linux-*"}, Deny: []string{"openssl"}},
+	}
+	expected := []policyViolation{
+		{Rule: "severities", Message: "1 Critical vulnerabilities, maximum is 0", Vulnerabilities: []string{"CVE-1"}},
+		{Rule: "severities", Message: "2 High vulnerabilities, maximum is 1", Vulnerabilities: []string{"CVE-2", "CVE-3"}},
+		{Rule: "max-cvss", Message: "CVE-1 in openssl 1.0 has CVSS score 9.8, maximum is 9.0", Vulnerabilities: []string{"CVE-1"}},
+		{Rule: "max-fixable-age-days", Message: "CVE-2 in bash 4.3 has been fixable in 4.4 for 516 days, maximum is 30", Vulnerabilities: []string{"CVE-2"}},
+		{Rule: "packages", Message: "CVE-1 in openssl 1.0, the package is denied", Vulnerabilities: []string{"CVE-1"}},
+	}
+	violations := p.evaluate(vs, now)
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected %+v\ngot %+v", expected, violations)
+	}
+
+	if violations := (&policy{Severities: map[string]int{"High": 5}}).evaluate(vs, now); len(violations) != 0 {
+		t.Errorf("expected no violations, got %+v", violations)
+	}
+}
+
+func TestCvssScore(t *testing.T) {
+	tests := []struct {
+		metadata map[string]interface{}
+		score    float64
+		ok       bool
+	}{
+		{nil, 0, false},
+		{map[string]interface{}{"NVD": map[string]interface{}{"CVSSv2": map[string]interface{}{"Score": 5.0}}}, 5.0, true},
+		{map[string]interface{}{"NVD": map[string]interface{}{
+			"CVSSv2": map[string]interface{}{"Score": 5.0},
+			"CVSSv3": map[string]interface{}{"Score": 7.5},
+		}}, 7.5, true},
+		{map[string]interface{}{"NVD": map[string]interface{}{"CVSSv3": map[string]interface{}{"Score": "6.1"}}}, 6.1, true},
+	}
+	for _, tc := range tests {
+		score, ok := cvssScore(&clair.Vulnerability{Metadata: tc.metadata})
+		if score != tc.score || ok != tc.ok {
+			t.Errorf("%v: expected %v %v, got %v %v", tc.metadata, tc.score, tc.ok, score, ok)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/optiopay/klar/docker"
+
+	"gopkg.in/yaml.v2"
+)
+
+// registriesFile is the KLAR_REGISTRIES file with settings of registry
+// hosts as in image names, Docker Hub is docker.io. Relative paths are
+// relative to the file.
+//
+//	registries:
+//	  172.31.29.60:5000:
+//	    ca: internal-ca.pem
+//	  docker.io:
+//	    mirrors: [mirror.internal:5000]
+type registriesFile struct {
+	Registries map[string]registrySettings `yaml:"registries"`
+}
+
+type registrySettings struct {
+	// CA is a PEM bundle verifying the registry instead of system roots
+	CA string `yaml:"ca"`
+	// Cert and Key are a PEM client certificate for the registry
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Insecure skips verification of the registry certificate
+	Insecure bool `yaml:"insecure"`
+	// HTTP connects to the registry with plain HTTP
+	HTTP bool `yaml:"http"`
+	// Mirrors are tried in order before the registry, host[:port] or URL
+	Mirrors []string `yaml:"mirrors"`
+}
+
+// parseRegistriesFile reads and validates the KLAR_REGISTRIES file
+func parseRegistriesFile(file string) (map[string]docker.RegistryConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read registries file: %s", err)
+	}
+	var f registriesFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("Can't decode registries file %s: %s", file, err)
+	}
+	dir := filepath.Dir(file)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	registries := make(map[string]docker.RegistryConfig, len(f.Registries))
+	for host, s := range f.Registries {
+		r := docker.RegistryConfig{
+			CAFile:    resolve(s.CA),
+			CertFile:  resolve(s.Cert),
+			KeyFile:   resolve(s.Key),
+			Insecure:  s.Insecure,
+			PlainHTTP: s.HTTP,
+			Mirrors:   s.Mirrors,
+		}
+		if _, err := r.TLSConfig(false); err != nil {
+			return nil, fmt.Errorf("Bad TLS settings of %s in registries file %s: %s", host, file, err)
+		}
+		registries[host] = r
+	}
+	return registries, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/optiopay/klar/docker"
+)
+
+func TestParseRegistriesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "klar-registries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(data string) string {
+		path := filepath.Join(dir, "registries.yaml")
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	registries, err := parseRegistriesFile(write(`registries:
+  docker.io:
+    mirrors: [mirror.internal:5000, "https://cache.internal"]
+  localhost:5000:
+    http: true
+  untrusted.internal:
+    insecure: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]docker.RegistryConfig{
+		"docker.io":          {Mirrors: []string{"mirror.internal:5000", "https://cache.internal"}},
+		"localhost:5000":     {PlainHTTP: true},
+		"untrusted.internal": {Insecure: true},
+	}
+	if !reflect.DeepEqual(registries, expected) {
+		t.Errorf("expected %+v got %+v", expected, registries)
+	}
+
+	// relative paths are relative to the file
+	_, err = parseRegistriesFile(write("registries:\n  172.31.29.60:5000:\n    ca: certs/ca.pem\n"))
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "certs", "ca.pem")) {
+		t.Errorf("expected an error for the missing CA file in %s, got %v", dir, err)
+	}
+	for _, bad := range []string{
+		"registries:\n  localhost:5000:\n    plain-http: true\n",
+		"registries:\n  registry.internal:\n    cert: klar.crt\n",
+		"localhost:5000:\n  http: true\n",
+	} {
+		if _, err := parseRegistriesFile(write(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
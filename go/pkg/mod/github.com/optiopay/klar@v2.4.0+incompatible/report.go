@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+
+	"github.com/optiopay/klar/clair"
+	"github.com/optiopay/klar/docker"
+)
+
+// report is the analysis of one image platform. Formats describing all
+// scanned images in one document are built from reports.
+type report struct {
+	// Image is the image name as given to klar
+	Image string
+	// Registry is the registry host, empty for local images
+	Registry   string
+	Repository string
+	Tag        string
+	Platform   string
+	Digest     string
+	LayerCount int
+	// Layers are digests of the analyzed layers, empty layers are skipped
+	Layers []string
+	// BaseLayers is the number of leading Layers of KLAR_BASE_IMAGE
+	BaseLayers      int
+	ClairAPIVersion int
+	ScanTime        time.Time
+	// Cached is set if the vulnerabilities were found in KLAR_CACHE_DIR,
+	// ScanTime is when Clair analysed the image then
+	Cached bool
+	// Vulnerabilities are found vulnerabilities which are not whitelisted
+	Vulnerabilities []*clair.Vulnerability
+	// Whitelisted are found vulnerabilities excluded by the whitelist
+	Whitelisted []*clair.Vulnerability
+	// Violations are the KLAR_POLICY rules the image violates
+	Violations []policyViolation
+	// Fixed are baseline vulnerabilities which are not found any more
+	Fixed []baselineFinding
+	// layers maps Clair layer names to layer digests
+	layers map[string]string
+	// instructions are the Dockerfile instructions which created Layers
+	instructions []string
+	// whitelistedBy maps Whitelisted to the whitelist entries excluding them
+	whitelistedBy map[*clair.Vulnerability]*whitelistEntry
+	// unchanged marks Vulnerabilities found in the baseline, it is nil
+	// without a baseline
+	unchanged map[*clair.Vulnerability]bool
+}
+
+// setLayers records analyzed layers of the image
+func (r *report) setLayers(image *docker.Image) {
+	r.layers = make(map[string]string, len(image.FsLayers))
+	r.Layers = make([]string, len(image.FsLayers))
+	r.instructions = make([]string, len(image.FsLayers))
+	for i, l := range image.FsLayers {
+		r.layers[image.LayerName(i)] = l.BlobSum
+		r.Layers[i] = l.BlobSum
+		r.instructions[i] = l.Instruction()
+	}
+}
+
+// layerDigest returns digest of the layer which added the vulnerable feature,
+// it is empty if Clair doesn't report it
+func (r *report) layerDigest(v *clair.Vulnerability) string {
+	return r.layers[v.AddedBy]
+}
+
+// countVulnerabilities returns the number of vulnerabilities which count
+// towards the threshold
+func (r *report) countVulnerabilities(conf *config) int {
+	vsNumber := 0
+	for _, v := range r.Vulnerabilities {
+		if r.counted(conf, v) {
+			vsNumber++
+		}
+	}
+	return vsNumber
+}
+
+// counted reports whether the vulnerability of the image counts towards
+// the threshold, vulnerabilities found in the baseline or inherited from
+// the base image don't
+func (r *report) counted(conf *config, v *clair.Vulnerability) bool {
+	return conf.counted(v) && !r.unchanged[v] && !r.inherited(v)
+}
+
+// severityIndex returns position of the severity in priorities,
+// -1 for severities klar doesn't know
+func severityIndex(sev string) int {
+	for i, p := range priorities {
+		if p == sev {
+			return i
+		}
+	}
+	return -1
+}
+
+// reported reports whether the vulnerability severity is at least CLAIR_OUTPUT
+func (conf *config) reported(v *clair.Vulnerability) bool {
+	i := severityIndex(v.Severity)
+	return i != -1 && i >= severityIndex(conf.ClairOutput)
+}
+
+// counted reports whether the vulnerability counts towards the threshold
+func (conf *config) counted(v *clair.Vulnerability) bool {
+	return conf.reported(v) && (!conf.IgnoreUnfixed || v.FixedBy != "")
+}
+
+// legacyJSON reports whether JSON output is in the format before
+// the versioned report, KLAR_JSON_VERSION=1
+func (conf *config) legacyJSON() bool {
+	return conf.JSONOutput && conf.JSONVersion == 1
+}
+
+// textOutput reports whether reports are written per image as text
+func (conf *config) textOutput() bool {
+	return conf.FormatStyle == "standard" || conf.FormatStyle == "table"
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/optiopay/klar/clair"
+)
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+	klarURI      = "https://github.com/optiopay/klar"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string                 `json:"id"`
+	ShortDescription     sarifMessage           `json:"shortDescription"`
+	FullDescription      *sarifMessage          `json:"fullDescription,omitempty"`
+	HelpURI              string                 `json:"helpUri,omitempty"`
+	DefaultConfiguration sarifConfiguration     `json:"defaultConfiguration"`
+	Properties           map[string]interface{} `json:"properties"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level   string       `json:"level"`
+	Message sarifMessage `json:"message"`
+}
+
+type sarifResult struct {
+	RuleID              string             `json:"ruleId"`
+	RuleIndex           int                `json:"ruleIndex"`
+	Level               string             `json:"level"`
+	Message             sarifMessage       `json:"message"`
+	Locations           []sarifLocation    `json:"locations"`
+	PartialFingerprints map[string]string  `json:"partialFingerprints"`
+	Suppressions        []sarifSuppression `json:"suppressions,omitempty"`
+	Properties          map[string]string  `json:"properties"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+type sarifSuppression struct {
+	Kind          string `json:"kind"`
+	Justification string `json:"justification"`
+}
+
+// sarifLevel maps Clair severity to SARIF result level
+func sarifLevel(sev string) string {
+	switch sev {
+	case "Defcon1", "Critical", "High":
+		return "error"
+	case "Medium":
+		return "warning"
+	}
+	return "note"
+}
+
+// sarifFormat writes one SARIF run with a result per vulnerability of every
+// image. Vulnerabilities below CLAIR_OUTPUT and whitelisted ones are
+// reported as suppressed results.
+func sarifFormat(w io.Writer, conf *config, results []*scanResult) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "klar",
+			Version:        version,
+			InformationURI: klarURI,
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+	invocation := sarifInvocation{ExecutionSuccessful: true}
+	rules := make(map[string]int)
+	add := func(rep *report, v *clair.Vulnerability, suppression *sarifSuppression) {
+		index, ok := rules[v.Name]
+		if !ok {
+			index = len(run.Tool.Driver.Rules)
+			rules[v.Name] = index
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, newSarifRule(v))
+		}
+		result := newSarifResult(rep, v)
+		result.RuleIndex = index
+		if suppression != nil {
+			result.Suppressions = []sarifSuppression{*suppression}
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	for _, r := range results {
+		if r.err != nil {
+			invocation.ExecutionSuccessful = false
+			invocation.ToolExecutionNotifications = append(invocation.ToolExecutionNotifications, sarifNotification{
+				Level:   "error",
+				Message: sarifMessage{Text: fmt.Sprintf("%s: %s", r.image, r.err)},
+			})
+		}
+		for _, rep := range r.reports {
+			for _, v := range rep.Vulnerabilities {
+				if conf.reported(v) {
+					add(rep, v, nil)
+				} else {
+					add(rep, v, &sarifSuppression{
+						Kind:          "external",
+						Justification: fmt.Sprintf("Severity is below %s", conf.ClairOutput),
+					})
+				}
+			}
+			for _, v := range rep.Whitelisted {
+				add(rep, v, &sarifSuppression{Kind: "external", Justification: "Whitelisted"})
+			}
+		}
+	}
+	run.Invocations = []sarifInvocation{invocation}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []sarifRun{run},
+	})
+}
+
+func newSarifRule(v *clair.Vulnerability) sarifRule {
+	rule := sarifRule{
+		ID:                   v.Name,
+		ShortDescription:     sarifMessage{Text: v.Name},
+		HelpURI:              v.Link,
+		DefaultConfiguration: sarifConfiguration{Level: sarifLevel(v.Severity)},
+		Properties: map[string]interface{}{
+			"severity": v.Severity,
+			"tags":     []string{"security", "vulnerability"},
+		},
+	}
+	if v.Description != "" {
+		rule.FullDescription = &sarifMessage{Text: v.Description}
+	}
+	return rule
+}
+
+// sarifImageURI returns the artifact URI of the image. A reference isn't a
+// URI, registry:5000/app:1 would have the scheme registry, so it is the
+// opaque part of an oci: URI. It isn't an authority, which can't hold tags
+// and digests.
+func sarifImageURI(image string) string {
+	return "oci:" + (&url.URL{Path: image}).EscapedPath()
+}
+
+// newSarifResult creates a result located at the package in the layer of the image
+func newSarifResult(rep *report, v *clair.Vulnerability) sarifResult {
+	layer := rep.layerDigest(v)
+	image := rep.Image
+	if rep.Platform != "" {
+		image += " " + rep.Platform
+	}
+	message := fmt.Sprintf("%s %s in %s is affected by %s", v.FeatureName, v.FeatureVersion, image, v.Name)
+	if v.FixedBy != "" {
+		message += fmt.Sprintf(", fixed by %s", v.FixedBy)
+	}
+	if v.Instruction != "" {
+		message += fmt.Sprintf(", added by %s", v.Instruction)
+	}
+	qualifiedName := rep.Image
+	if layer != "" {
+		qualifiedName += "/" + layer
+	}
+	qualifiedName += "/" + v.FeatureName
+	return sarifResult{
+		RuleID:  v.Name,
+		Level:   sarifLevel(v.Severity),
+		Message: sarifMessage{Text: message},
+		Locations: []sarifLocation{{
+			PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: sarifImageURI(rep.Image)}},
+			LogicalLocations: []sarifLogicalLocation{{
+				Name:               v.FeatureName,
+				FullyQualifiedName: qualifiedName,
+				Kind:               "package",
+			}},
+		}},
+		PartialFingerprints: map[string]string{
+			"klarVulnerability/v1": fmt.Sprintf("%s/%s/%s/%s", rep.Image, rep.Platform, v.FeatureName, v.Name),
+		},
+		Properties: map[string]string{
+			"image":            rep.Image,
+			"platform":         rep.Platform,
+			"digest":           rep.Digest,
+			"layer":            layer,
+			"instruction":      v.Instruction,
+			"package":          v.FeatureName,
+			"installedVersion": v.FeatureVersion,
+			"fixedBy":          v.FixedBy,
+			"severity":         v.Severity,
+		},
+	}
+}
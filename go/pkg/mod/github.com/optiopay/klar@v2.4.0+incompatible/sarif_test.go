@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/optiopay/klar/clair"
+)
+
+// testResults returns a scanned image with a High, a Low and a whitelisted
+// vulnerability and an image which couldn't be scanned
+func testResults() []*scanResult {
+	high := &clair.Vulnerability{Name: "CVE-1", Severity: "High", FeatureName: "openssl", FeatureVersion: "1.0.2", FixedBy: "1.0.3", AddedBy: "layer2",
+		Instruction: "RUN apt-get install -y openssl"}
+	low := &clair.Vulnerability{Name: "CVE-2", Severity: "Low", FeatureName: "bash", FeatureVersion: "4.3"}
+	whitelisted := &clair.Vulnerability{Name: "CVE-3", Severity: "Critical", FeatureName: "zlib", FeatureVersion: "1.2"}
+	return []*scanResult{
+		{
+			image: "postgres:9.5.1",
+			reports: []*report{{
+				Image:           "postgres:9.5.1",
+				LayerCount:      2,
+				Layers:          []string{"sha256:aaa", "sha256:bbb"},
+				Vulnerabilities: []*clair.Vulnerability{high, low},
+				Whitelisted:     []*clair.Vulnerability{whitelisted},
+				layers:          map[string]string{"layer1": "sha256:aaa", "layer2": "sha256:bbb"},
+				instructions:    []string{"ADD file:abc in /", "RUN apt-get install -y openssl"},
+			}},
+		},
+		{
+			image: "nginx:missing",
+			err:   errors.New("Can't pull image"),
+		},
+	}
+}
+
+func TestSarifFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := sarifFormat(&buf, &config{ClairOutput: "Medium"}, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("Can't decode SARIF: %s", err)
+	}
+	if log.Version != sarifVersion || len(log.Runs) != 1 {
+		t.Fatalf("Unexpected SARIF log %+v", log)
+	}
+	run := log.Runs[0]
+	if len(run.Tool.Driver.Rules) != 3 || len(run.Results) != 3 {
+		t.Fatalf("Expected 3 rules and results, got %d and %d", len(run.Tool.Driver.Rules), len(run.Results))
+	}
+	if run.Invocations[0].ExecutionSuccessful || len(run.Invocations[0].ToolExecutionNotifications) != 1 {
+		t.Errorf("Expected a failed invocation, got %+v", run.Invocations[0])
+	}
+
+	expected := map[string]struct {
+		level      string
+		suppressed bool
+	}{
+		"CVE-1": {"error", false},
+		"CVE-2": {"note", true},
+		"CVE-3": {"error", true},
+	}
+	for _, r := range run.Results {
+		e := expected[r.RuleID]
+		if r.Level != e.level || (len(r.Suppressions) > 0) != e.suppressed {
+			t.Errorf("%s: expected level %s and suppressed %v, got %s and %v", r.RuleID, e.level, e.suppressed, r.Level, r.Suppressions)
+		}
+		if run.Tool.Driver.Rules[r.RuleIndex].ID != r.RuleID {
+			t.Errorf("%s: rule index %d points to %s", r.RuleID, r.RuleIndex, run.Tool.Driver.Rules[r.RuleIndex].ID)
+		}
+	}
+	if fqn := run.Results[0].Locations[0].LogicalLocations[0].FullyQualifiedName; fqn != "postgres:9.5.1/sha256:bbb/openssl" {
+		t.Errorf("Unexpected location %s", fqn)
+	}
+	if uri := run.Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI; uri != "oci:postgres:9.5.1" {
+		t.Errorf("Unexpected artifact URI %s", uri)
+	}
+}
+
+func TestSarifImageURI(t *testing.T) {
+	for _, image := range []string{
+		"postgres:9.5.1",
+		"registry:5000/app:1",
+		"registry:5000/team/app@sha256:0123456789abcdef",
+	} {
+		u, err := url.Parse(sarifImageURI(image))
+		if err != nil {
+			t.Errorf("%s: %s", image, err)
+			continue
+		}
+		if u.Scheme != "oci" || u.Opaque != image {
+			t.Errorf("%s: expected the reference in an oci URI, got scheme %s and %s", image, u.Scheme, u.Opaque)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+	"github.com/optiopay/klar/docker"
+	"github.com/optiopay/klar/utils"
+)
+
+// scanResult is the report of one image. It is ready when done is closed.
+type scanResult struct {
+	image string
+	// report is the text output
+	report        bytes.Buffer
+	outputs       []jsonOutput
+	reports       []*report
+	overThreshold bool
+	err           error
+	done          chan struct{}
+}
+
+// serveLock serializes scans of images served to Clair by klar
+// if the blob server listens on a fixed port
+var serveLock sync.Mutex
+
+// scanImages scans conf.Images with conf.Workers goroutines. Results are
+// in the order of conf.Images and become ready as the scans finish.
+func scanImages(conf *config, whitelist *vulnerabilitiesWhitelist) []*scanResult {
+	results := make([]*scanResult, len(conf.Images))
+	for i, name := range conf.Images {
+		results[i] = &scanResult{image: name, done: make(chan struct{})}
+	}
+	jobs := make(chan *scanResult)
+	for w := 0; w < conf.Workers; w++ {
+		go func() {
+			for r := range jobs {
+				scanImage(conf, whitelist, r)
+				close(r.done)
+			}
+		}()
+	}
+	go func() {
+		for _, r := range results {
+			jobs <- r
+		}
+		close(jobs)
+	}()
+	return results
+}
+
+// scanImage pulls the image, every platform of it with AllPlatforms,
+// and analyses it with Clair
+func scanImage(conf *config, whitelist *vulnerabilitiesWhitelist, r *scanResult) {
+	dockerConfig := conf.DockerConfig
+	dockerConfig.ImageName = r.image
+	image, err := docker.NewImage(&dockerConfig)
+	if err != nil {
+		r.err = fmt.Errorf("Can't parse qname: %s", err)
+		return
+	}
+	if (image.IsLocal() || dockerConfig.Proxy) && fixedPort(dockerConfig.ServeAddr) {
+		serveLock.Lock()
+		defer serveLock.Unlock()
+	}
+	defer image.Close()
+
+	images := []*docker.Image{image}
+	if conf.AllPlatforms {
+		images, err = image.PullPlatforms()
+	} else {
+		err = image.Pull()
+	}
+	if err != nil {
+		r.err = fmt.Errorf("Can't pull image: %s", conf.scanError("pulling image", err))
+		return
+	}
+
+	multiPlatform := len(images) > 1
+	for _, image := range images {
+		if multiPlatform && conf.textOutput() {
+			fmt.Fprintf(&r.report, "Platform %s (%s)\n", image.Platform, image.Digest)
+		}
+
+		rep, vsNumber, err := analyse(conf, whitelist, r.image, image, &r.report)
+		if err != nil {
+			r.err = err
+			return
+		}
+		rep.Digest = image.Digest
+		if multiPlatform {
+			rep.Platform = image.Platform.String()
+		}
+		r.reports = append(r.reports, rep)
+		if conf.base != nil {
+			rep.BaseLayers = conf.base.sharedLayers(image.Platform.String(), rep.Layers)
+			vsNumber = rep.countVulnerabilities(conf)
+			if conf.textOutput() {
+				writeBase(&r.report, conf, rep)
+			}
+		}
+		if conf.baseline != nil {
+			rep.compareBaseline(conf.baseline)
+			vsNumber = rep.countVulnerabilities(conf)
+			if conf.textOutput() {
+				writeBaseline(&r.report, rep)
+			}
+		}
+		if conf.legacyJSON() {
+			output := jsonOutput{
+				Platform:        rep.Platform,
+				LayerCount:      rep.LayerCount,
+				Vulnerabilities: make(map[string][]*clair.Vulnerability),
+			}
+			if multiPlatform {
+				output.Digest = rep.Digest
+			}
+			collectJSONOutput(conf, groupBySeverity(rep.Vulnerabilities), output)
+			r.outputs = append(r.outputs, output)
+		}
+		if conf.policy != nil {
+			rep.Violations = conf.policy.evaluate(rep.introduced(), time.Now())
+			if conf.textOutput() {
+				writeViolations(&r.report, rep.Violations)
+				if multiPlatform {
+					fmt.Fprintln(&r.report)
+				}
+			}
+		} else if multiPlatform && conf.textOutput() {
+			fmt.Fprintf(&r.report, "Platform %s: %d vulnerabilities counted towards the threshold\n\n", image.Platform, vsNumber)
+		}
+		if conf.failed(rep) {
+			r.overThreshold = true
+		}
+	}
+}
+
+// scanError names the phase of the scan if err is a timeout and the scan
+// deadline if it was exceeded, other errors are returned as they are
+func (conf *config) scanError(phase string, err error) error {
+	if conf.ctx != nil && conf.ctx.Err() == context.DeadlineExceeded {
+		return &utils.TimeoutError{Phase: phase, Err: fmt.Errorf("%s %s exceeded: %s", optionKlarScanTimeout, conf.ScanTimeout, err)}
+	}
+	return utils.WithPhase(nil, phase, err)
+}
+
+// fixedPort reports whether the listen address has a port other than 0
+func fixedPort(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != "0"
+}
+
+// exitCode returns 2 if any image couldn't be analyzed, 1 if any image
+// is over the threshold and 0 otherwise
+func exitCode(results []*scanResult) int {
+	code := 0
+	for _, r := range results {
+		if r.err != nil {
+			return 2
+		}
+		if r.overThreshold {
+			code = 1
+		}
+	}
+	return code
+}
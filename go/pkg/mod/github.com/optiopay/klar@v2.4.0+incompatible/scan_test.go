@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScanImagesOrder(t *testing.T) {
+	conf := &config{
+		Images:  []string{"Invalid", "docker-archive:/nonexistent.tar", "UPPER/case"},
+		Workers: 2,
+	}
+	results := scanImages(conf, &vulnerabilitiesWhitelist{})
+	for i, r := range results {
+		<-r.done
+		if r.image != conf.Images[i] {
+			t.Errorf("expected result %d for %s, got %s", i, conf.Images[i], r.image)
+		}
+		if r.err == nil {
+			t.Errorf("%s: expected an error", r.image)
+		}
+	}
+	if code := exitCode(results); code != 2 {
+		t.Errorf("expected exit code 2, got %d", code)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		results  []*scanResult
+		expected int
+	}{
+		{
+			results:  []*scanResult{{}, {}},
+			expected: 0,
+		},
+		{
+			results:  []*scanResult{{}, {overThreshold: true}},
+			expected: 1,
+		},
+		{
+			results:  []*scanResult{{overThreshold: true}, {err: errors.New("pull failed")}},
+			expected: 2,
+		},
+	}
+	for i, tc := range cases {
+		if code := exitCode(tc.results); code != tc.expected {
+			t.Errorf("case %d: expected %d got %d", i, tc.expected, code)
+		}
+	}
+}
+
+func TestFixedPort(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"":             false,
+		":0":           false,
+		"0.0.0.0:6070": true,
+		":6070":        true,
+	} {
+		if got := fixedPort(addr); got != expected {
+			t.Errorf("%q: expected %v got %v", addr, expected, got)
+		}
+	}
+}
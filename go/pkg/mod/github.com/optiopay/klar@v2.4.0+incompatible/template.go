@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/optiopay/klar/clair"
+)
+
+// templateReport is the data FORMAT_TEMPLATE is executed with
+type templateReport struct {
+	Version     string
+	ClairOutput string
+	Threshold   int
+	Images      []templateImage
+}
+
+// templateImage is the report of one image platform or an image which
+// couldn't be analyzed, then only Image and Error are set
+type templateImage struct {
+	Image      string
+	Platform   string
+	Digest     string
+	Error      string
+	LayerCount int
+	// Severities groups Vulnerabilities by severity, from the highest
+	Severities []templateSeverity
+	// Vulnerabilities are not whitelisted vulnerabilities, from the highest severity
+	Vulnerabilities []templateVulnerability
+	Whitelisted     []templateVulnerability
+	// Counted is the number of vulnerabilities which count towards the threshold
+	Counted int
+	// Violations are the KLAR_POLICY rules the image violates
+	Violations []policyViolation
+	// Fixed are baseline vulnerabilities which are not found any more
+	Fixed []baselineFinding
+	// Inherited is the number of counted vulnerabilities inherited from
+	// KLAR_BASE_IMAGE, they are not in Counted
+	Inherited int
+	// OverThreshold is set if the image is over the threshold or violates the policy
+	OverThreshold bool
+}
+
+type templateSeverity struct {
+	Severity        string
+	Vulnerabilities []templateVulnerability
+}
+
+type templateVulnerability struct {
+	Name          string
+	Severity      string
+	NamespaceName string
+	Package       string
+	Version       string
+	FixedBy       string
+	Layer         string
+	// Instruction is the Dockerfile instruction which created Layer
+	Instruction string
+	Link        string
+	Description string
+	// Reported is set if the severity is at least CLAIR_OUTPUT
+	Reported bool
+	// Counted is set if the vulnerability counts towards the threshold
+	Counted     bool
+	Whitelisted bool
+	// New is set if the image is compared with a baseline which doesn't
+	// have the vulnerability
+	New bool
+	// Inherited is set if a layer of KLAR_BASE_IMAGE added the package
+	Inherited bool
+	// WhitelistEntry is the entry excluding a Whitelisted vulnerability,
+	// empty otherwise
+	WhitelistEntry templateWhitelistEntry
+}
+
+// templateWhitelistEntry is the whitelist decision reviewers audit,
+// Expires is YYYY-MM-DD or empty if the entry doesn't expire
+type templateWhitelistEntry struct {
+	Owner   string
+	Reason  string
+	Expires string
+}
+
+func newTemplateWhitelistEntry(e *whitelistEntry) templateWhitelistEntry {
+	if e == nil {
+		return templateWhitelistEntry{}
+	}
+	return templateWhitelistEntry{Owner: e.Owner, Reason: e.Reason, Expires: e.expiresDate()}
+}
+
+// templateFuncs are helper functions available in templates in addition
+// to text/template builtins
+var templateFuncs = template.FuncMap{
+	// atLeast reports whether severity is at least min: {{if atLeast .Severity "High"}}
+	"atLeast": func(severity, min string) bool {
+		return severityIndex(severity) >= severityIndex(min)
+	},
+	"severityRank": severityIndex,
+	// truncate shortens s to n characters adding an ellipsis
+	"truncate": func(n int, s string) string {
+		if utf8.RuneCountInString(s) <= n {
+			return s
+		}
+		return string([]rune(s)[:n]) + "…"
+	},
+	// csv quotes a field if needed
+	"csv": func(s string) string {
+		var b bytes.Buffer
+		w := csv.NewWriter(&b)
+		w.Write([]string{s})
+		w.Flush()
+		return strings.TrimSuffix(b.String(), "\n")
+	},
+	// markdown escapes characters with meaning in Markdown tables and text
+	"markdown": func(s string) string {
+		s = strings.Replace(s, "\n", " ", -1)
+		for _, c := range []string{"\\", "|", "*", "_", "`", "[", "]", "<", ">", "#"} {
+			s = strings.Replace(s, c, "\\"+c, -1)
+		}
+		return s
+	},
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// parseTemplate parses the FORMAT_TEMPLATE file
+func parseTemplate(path string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read template: %s", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse template: %s", err)
+	}
+	return tmpl, nil
+}
+
+// templateFormat executes the user template once for all images
+func templateFormat(w io.Writer, conf *config, results []*scanResult) error {
+	report := templateReport{
+		Version:     version,
+		ClairOutput: conf.ClairOutput,
+		Threshold:   conf.Threshold,
+	}
+	for _, r := range results {
+		if r.err != nil {
+			report.Images = append(report.Images, templateImage{Image: r.image, Error: r.err.Error()})
+			continue
+		}
+		for _, rep := range r.reports {
+			report.Images = append(report.Images, newTemplateImage(conf, rep))
+		}
+	}
+	return conf.template.Execute(w, report)
+}
+
+func newTemplateImage(conf *config, rep *report) templateImage {
+	image := templateImage{
+		Image:         rep.Image,
+		Platform:      rep.Platform,
+		Digest:        rep.Digest,
+		LayerCount:    rep.LayerCount,
+		Counted:       rep.countVulnerabilities(conf),
+		Violations:    rep.Violations,
+		Fixed:         rep.Fixed,
+		Inherited:     rep.countInherited(conf),
+		OverThreshold: conf.failed(rep),
+	}
+	store := groupBySeverity(rep.Vulnerabilities)
+	var severities []string
+	iteratePriorities(priorities[0], store, func(sev string) {
+		severities = append([]string{sev}, severities...)
+	})
+	for _, sev := range severities {
+		group := templateSeverity{Severity: sev}
+		for _, v := range store[sev] {
+			group.Vulnerabilities = append(group.Vulnerabilities, newTemplateVulnerability(conf, rep, v, false))
+		}
+		image.Severities = append(image.Severities, group)
+		image.Vulnerabilities = append(image.Vulnerabilities, group.Vulnerabilities...)
+	}
+	for _, v := range rep.Whitelisted {
+		image.Whitelisted = append(image.Whitelisted, newTemplateVulnerability(conf, rep, v, true))
+	}
+	return image
+}
+
+func newTemplateVulnerability(conf *config, rep *report, v *clair.Vulnerability, whitelisted bool) templateVulnerability {
+	vuln := templateVulnerability{
+		Name:          v.Name,
+		Severity:      v.Severity,
+		NamespaceName: v.NamespaceName,
+		Package:       v.FeatureName,
+		Version:       v.FeatureVersion,
+		FixedBy:       v.FixedBy,
+		Layer:         rep.layerDigest(v),
+		Instruction:   v.Instruction,
+		Link:          v.Link,
+		Description:   v.Description,
+		Reported:      conf.reported(v),
+		Counted:       !whitelisted && rep.counted(conf, v),
+		Whitelisted:   whitelisted,
+		New:           rep.unchanged != nil && !whitelisted && !rep.unchanged[v],
+		Inherited:     rep.inherited(v),
+	}
+	if whitelisted {
+		vuln.WhitelistEntry = newTemplateWhitelistEntry(rep.whitelistedBy[v])
+	}
+	return vuln
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+func newTestTemplate(text string) (*template.Template, error) {
+	return template.New("test").Funcs(templateFuncs).Parse(text)
+}
+
+func TestTemplateFormatExamples(t *testing.T) {
+	results := testResults()
+	rep := results[0].reports[0]
+	rep.Vulnerabilities[0].FeatureVersion = "1.0.2, patched"
+	rep.whitelistedBy = map[*clair.Vulnerability]*whitelistEntry{
+		rep.Whitelisted[0]: {CVE: "CVE-3", Owner: "platform", Reason: "not reachable, no network", Expires: time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	tmpl, err := parseTemplate("templates/csv.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := templateFormat(&buf, &config{ClairOutput: "Medium", template: tmpl}, results); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Can't read CSV output: %s", err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected a header and 3 records, got %d", len(records))
+	}
+	if records[1][3] != "CVE-1" || records[1][5] != "1.0.2, patched" || records[1][7] != "sha256:bbb" {
+		t.Errorf("Unexpected record %v", records[1])
+	}
+	if records[3][3] != "CVE-3" || records[3][8] != "true" {
+		t.Errorf("Unexpected whitelisted record %v", records[3])
+	}
+	if records[3][10] != "platform" || records[3][11] != "not reachable, no network" || records[3][12] != "2019-12-31" {
+		t.Errorf("Expected the whitelist entry in %v", records[3])
+	}
+	if records[1][10] != "" {
+		t.Errorf("Expected no whitelist entry in %v", records[1])
+	}
+
+	if tmpl, err = parseTemplate("templates/markdown.tmpl"); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := templateFormat(&buf, &config{ClairOutput: "Medium", template: tmpl}, results); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{"### postgres:9.5.1", "| High | [CVE-1]", "Whitelisted: CVE-3", "Scan failed: Can't pull image"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected Markdown output to contain %q:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "CVE-2") {
+		t.Errorf("Expected CVE-2 below CLAIR_OUTPUT to be left out:\n%s", out)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{`{{atLeast "Critical" "High"}} {{atLeast "Low" "High"}}`, "true false"},
+		{`{{truncate 5 "vulnerability"}}`, "vulne…"},
+		{`{{csv "a,b"}} {{csv "plain"}}`, `"a,b" plain`},
+		{`{{markdown "a|b_c"}}`, `a\|b\_c`},
+		{`{{severityRank "Medium"}}`, "3"},
+	}
+	for _, tc := range cases {
+		tmpl, err := newTestTemplate(tc.text)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.text, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, nil); err != nil {
+			t.Fatalf("%s: %s", tc.text, err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%s: expected %s got %s", tc.text, tc.expected, buf.String())
+		}
+	}
+}
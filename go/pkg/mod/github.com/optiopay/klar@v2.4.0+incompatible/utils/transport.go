@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRetries is the number of times a failed request is repeated
+	DefaultRetries = 3
+	// MaxRetryAfter limits how long a Retry-After header can make klar wait
+	MaxRetryAfter = time.Minute
+
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// RetryTransport repeats requests which failed with a network error if they
+// are idempotent and requests answered with 5xx or 429 Too Many Requests,
+// waiting with exponential backoff and jitter in between. Requests made
+// without a context get Context, e.g. the scan deadline.
+type RetryTransport struct {
+	Base    http.RoundTripper
+	Retries int
+	// Timeout limits every attempt including reading the response body
+	Timeout time.Duration
+	Context context.Context
+}
+
+// cancelBody cancels the context of the attempt when the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// NewTransport returns the transport for registry and Clair requests,
+// retries is DefaultRetries if 0 and negative value disables retries
+func NewTransport(tlsConfig *tls.Config, timeout time.Duration, retries int, ctx context.Context) *RetryTransport {
+	if retries == 0 {
+		retries = DefaultRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &RetryTransport{
+		Base: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Retries: retries,
+		Timeout: timeout,
+		Context: ctx,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Context != nil && req.Context().Done() == nil {
+		req = req.WithContext(t.Context)
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := t.attempt(req, attempt)
+		if attempt >= t.Retries || ctx.Err() != nil || !retryable(req, resp, err) {
+			return resp, err
+		}
+		wait := Backoff(attempt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Request to %s failed, retrying in %s: %s\n", req.URL.Host, wait, err)
+		} else {
+			if resp.StatusCode == http.StatusTooManyRequests {
+				wait = RetryAfter(resp.Header.Get("Retry-After"), wait)
+			}
+			fmt.Fprintf(os.Stderr, "%s responded %s, retrying in %s\n", req.URL.Host, resp.Status, wait)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends the request with a fresh body and the attempt timeout
+func (t *RetryTransport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+	}
+	r := req.WithContext(ctx)
+	if attempt > 0 && req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+	resp, err := t.Base.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// retryable reports whether the request can be repeated after the response
+// or error, request bodies must be replayable
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return idempotent(req.Method) && !permanent(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// permanent reports whether a network error won't go away by retrying,
+// e.g. an unknown host
+func permanent(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if dns, ok := err.(*net.DNSError); ok {
+		return !dns.Temporary() && !dns.Timeout()
+	}
+	return false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Backoff returns the wait before the retry after attempt, it doubles
+// with every attempt and is randomized not to retry in lockstep
+func Backoff(attempt int) time.Duration {
+	d := minBackoff << uint(attempt)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+// RetryAfter parses Retry-After header which is either seconds or HTTP date
+func RetryAfter(header string, fallback time.Duration) time.Duration {
+	wait := fallback
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		wait = time.Until(t)
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > MaxRetryAfter {
+		wait = MaxRetryAfter
+	}
+	return wait
+}
+
+// TimeoutError names the phase of the scan which ran out of time
+type TimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Timeout %s: %s", e.Phase, e.Err)
+}
+
+// Timeout reports whether the error is a timeout
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// WithPhase returns a TimeoutError naming the phase if err is a timeout
+// or the deadline of ctx is exceeded, err otherwise
+func WithPhase(ctx context.Context, phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return err
+	}
+	if t, ok := err.(interface {
+		Timeout() bool
+	}); ok && t.Timeout() {
+		return &TimeoutError{Phase: phase, Err: err}
+	}
+	if ctx != nil && ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Phase: phase, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	if d := RetryAfter("3", time.Second); d != 3*time.Second {
+		t.Errorf("expected 3s got %s", d)
+	}
+	if d := RetryAfter("", time.Second); d != time.Second {
+		t.Errorf("expected fallback 1s got %s", d)
+	}
+	if d := RetryAfter("86400", time.Second); d != MaxRetryAfter {
+		t.Errorf("expected %s got %s", MaxRetryAfter, d)
+	}
+	if d := RetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), time.Second); d != 0 {
+		t.Errorf("expected 0 got %s", d)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		max := minBackoff << uint(attempt)
+		if max > maxBackoff || max <= 0 {
+			max = maxBackoff
+		}
+		if d := Backoff(attempt); d < max/2 || d > max {
+			t.Errorf("attempt %d: backoff %s is not between %s and %s", attempt, d, max/2, max)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "layer" {
+			t.Errorf("Request %d has body %q", requests, body)
+		}
+		switch requests {
+		case 1:
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, time.Second, 2, nil)}
+	resp, err := client.Post(ts.URL, "text/plain", strings.NewReader("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || requests != 3 {
+		t.Errorf("Expected 201 after 3 requests, got %d after %d", resp.StatusCode, requests)
+	}
+
+	// retries are exhausted, the last response is returned
+	requests = 0
+	client.Transport.(*RetryTransport).Retries = 1
+	resp, err = client.Post(ts.URL, "text/plain", strings.NewReader("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || requests != 2 {
+		t.Errorf("Expected 429 after 2 requests, got %d after %d", resp.StatusCode, requests)
+	}
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client := &http.Client{Transport: NewTransport(nil, 10*time.Millisecond, 100, ctx)}
+	_, err := client.Get(ts.URL)
+	if err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	if ctx.Err() == nil {
+		t.Error("Expected attempts to be retried until the deadline")
+	}
+	err = WithPhase(ctx, "pulling manifest", err)
+	if e, ok := err.(*TimeoutError); !ok || e.Phase != "pulling manifest" {
+		t.Errorf("Expected a timeout of the phase, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "Timeout pulling manifest: ") {
+		t.Errorf("Unexpected message %s", err)
+	}
+}
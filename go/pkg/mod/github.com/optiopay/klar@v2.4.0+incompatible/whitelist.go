@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+const (
+	// whitelistExpiresLayout is the layout of expiry dates, the entry
+	// applies until the end of the day in UTC
+	whitelistExpiresLayout = "2006-01-02"
+	// officialRepoPrefix is the repository path prefix of official Docker Hub images
+	officialRepoPrefix = "library/"
+)
+
+// whitelistEntryYAML is an entry of the whitelist entries section:
+//
+//	entries:
+//	  - cve: CVE-2018-1000001
+//	    owner: platform-team
+//	    reason: no setuid binaries in the image
+//	    expires: 2019-12-31
+//	    package: glibc
+//	    version: 2.24-11+deb9u1
+//	    images:
+//	      - registry.example.com/team/*
+type whitelistEntryYAML struct {
+	CVE     string
+	Owner   string
+	Reason  string
+	Expires string
+	Package string
+	Version string
+	Images  []string
+}
+
+// whitelistEntry excludes a CVE. Package, Version and Images limit it to
+// matching vulnerabilities, all of them apply if empty.
+type whitelistEntry struct {
+	CVE     string
+	Owner   string
+	Reason  string
+	Expires time.Time
+	Package string
+	Version string
+	// Images are [registry/]repository[:tag] patterns as in path.Match
+	Images []string
+	// expired entries don't apply any more
+	expired bool
+	// used is set when the entry excludes a vulnerability
+	used bool
+}
+
+// imageRef identifies the scanned image for whitelist image patterns,
+// registry is empty for local images
+type imageRef struct {
+	registry   string
+	repository string
+	tag        string
+}
+
+func newWhitelistEntry(y whitelistEntryYAML) (*whitelistEntry, error) {
+	if y.CVE == "" {
+		return nil, fmt.Errorf("cve is missing")
+	}
+	e := &whitelistEntry{
+		CVE:     y.CVE,
+		Owner:   y.Owner,
+		Reason:  y.Reason,
+		Package: y.Package,
+		Version: y.Version,
+	}
+	if y.Version != "" && y.Package == "" {
+		return nil, fmt.Errorf("version of %s requires a package", y.CVE)
+	}
+	if y.Expires != "" {
+		expires, err := time.Parse(whitelistExpiresLayout, y.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("expiry date of %s is not YYYY-MM-DD: %s", y.CVE, y.Expires)
+		}
+		e.Expires = expires
+	}
+	for _, pattern := range y.Images {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad image pattern %s of %s: %v", pattern, y.CVE, err)
+		}
+		e.Images = append(e.Images, pattern)
+	}
+	return e, nil
+}
+
+func (e *whitelistEntry) String() string {
+	s := e.CVE
+	if e.Package != "" {
+		s += " in " + strings.TrimSpace(e.Package+" "+e.Version)
+	}
+	if len(e.Images) > 0 {
+		s += " for " + strings.Join(e.Images, ", ")
+	}
+	if e.Owner != "" {
+		s += " (" + e.Owner + ")"
+	}
+	return s
+}
+
+// expiresDate returns the expiry date as YYYY-MM-DD, empty if the entry
+// doesn't expire
+func (e *whitelistEntry) expiresDate() string {
+	if e.Expires.IsZero() {
+		return ""
+	}
+	return e.Expires.Format(whitelistExpiresLayout)
+}
+
+// matches reports whether the entry applies to the vulnerability of the image
+func (e *whitelistEntry) matches(v *clair.Vulnerability, image imageRef) bool {
+	if e.expired || e.CVE != v.Name {
+		return false
+	}
+	if e.Package != "" && e.Package != v.FeatureName {
+		return false
+	}
+	if e.Version != "" && e.Version != v.FeatureVersion {
+		return false
+	}
+	if len(e.Images) == 0 {
+		return true
+	}
+	for _, pattern := range e.Images {
+		if image.matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the image matches a [registry/]repository[:tag]
+// pattern. Patterns without a registry match any registry, official Docker
+// Hub images match without library/ and patterns without a tag match any tag.
+func (image imageRef) matches(pattern string) bool {
+	if strings.LastIndex(pattern, ":") <= strings.LastIndex(pattern, "/") {
+		pattern += ":*"
+	}
+	tag := ":" + image.tag
+	names := []string{image.repository + tag}
+	if image.registry != "" {
+		names = append(names, image.registry+"/"+image.repository+tag)
+	}
+	if strings.HasPrefix(image.repository, officialRepoPrefix) {
+		names = append(names, strings.TrimPrefix(image.repository, officialRepoPrefix)+tag)
+	}
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the entry excluding the vulnerability of the image, nil if
+// it isn't whitelisted
+func (whitelist *vulnerabilitiesWhitelist) match(v *clair.Vulnerability, image imageRef) *whitelistEntry {
+	for _, e := range whitelist.byCVE[v.Name] {
+		if e.matches(v, image) {
+			whitelist.mu.Lock()
+			e.used = true
+			whitelist.mu.Unlock()
+			return e
+		}
+	}
+	return nil
+}
+
+// expire disables entries which expired before now and returns them
+func (whitelist *vulnerabilitiesWhitelist) expire(now time.Time) []*whitelistEntry {
+	var expired []*whitelistEntry
+	for _, e := range whitelist.Entries {
+		if !e.Expires.IsZero() && !now.Before(e.Expires.AddDate(0, 0, 1)) {
+			e.expired = true
+			expired = append(expired, e)
+		}
+	}
+	return expired
+}
+
+// unused returns entries which haven't excluded any vulnerability,
+// expired ones are not included
+func (whitelist *vulnerabilitiesWhitelist) unused() []*whitelistEntry {
+	whitelist.mu.Lock()
+	defer whitelist.mu.Unlock()
+	var unused []*whitelistEntry
+	for _, e := range whitelist.Entries {
+		if !e.used && !e.expired {
+			unused = append(unused, e)
+		}
+	}
+	return unused
+}
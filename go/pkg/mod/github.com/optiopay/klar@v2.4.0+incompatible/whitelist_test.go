@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/optiopay/klar/clair"
+)
+
+func TestParseWhitelistFile(t *testing.T) {
+	whitelist, err := parseWhitelistFile("whitelist-example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(whitelist.Entries) != 8 {
+		t.Fatalf("Expected 8 entries, got %d", len(whitelist.Entries))
+	}
+	e := whitelist.byCVE["CVE-2018-1000001"][0]
+	expected := &whitelistEntry{
+		CVE:     "CVE-2018-1000001",
+		Owner:   "platform-team",
+		Reason:  "no setuid binaries in our images",
+		Expires: time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC),
+		Package: "glibc",
+		Version: "2.24-11+deb9u1",
+		Images:  []string{"registry.example.com/team/*", "debian:9*"},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, e)
+	}
+
+	for _, bad := range []whitelistEntryYAML{
+		{Owner: "nobody"},
+		{CVE: "CVE-1", Expires: "next year"},
+		{CVE: "CVE-1", Version: "1.0"},
+		{CVE: "CVE-1", Images: []string{"["}},
+	} {
+		if _, err := newWhitelist(vulnerabilitiesWhitelistYAML{Entries: []whitelistEntryYAML{bad}}); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestImageRefMatches(t *testing.T) {
+	app := imageRef{registry: "registry.example.com", repository: "team/app", tag: "1.0"}
+	debian := imageRef{registry: "docker.io", repository: "library/debian", tag: "9.5"}
+	local := imageRef{repository: "team/app", tag: "dev"}
+	tests := []struct {
+		image   imageRef
+		pattern string
+		matches bool
+	}{
+		{app, "team/app", true},
+		{app, "registry.example.com/team/app", true},
+		{app, "registry.example.com/team/*", true},
+		{app, "registry.example.com/team/*:1.*", true},
+		{app, "registry.example.com/team/*:2.*", false},
+		{app, "other.example.com/team/app", false},
+		{app, "*/team/app:1.0", true},
+		{app, "team/*/app", false},
+		{debian, "debian", true},
+		{debian, "debian:9*", true},
+		{debian, "library/debian:9.5", true},
+		{debian, "docker.io/library/debian", true},
+		{debian, "debian:8", false},
+		{local, "team/app:dev", true},
+		{local, "registry.example.com/team/app", false},
+	}
+	for _, tc := range tests {
+		if matches := tc.image.matches(tc.pattern); matches != tc.matches {
+			t.Errorf("%+v %s: expected %v, got %v", tc.image, tc.pattern, tc.matches, matches)
+		}
+	}
+}
+
+func TestWhitelistEntries(t *testing.T) {
+	whitelist, err := newWhitelist(vulnerabilitiesWhitelistYAML{Entries: []whitelistEntryYAML{
+		{CVE: "CVE-1", Package: "openssl", Version: "1.0.2"},
+		{CVE: "CVE-2", Images: []string{"team/*"}},
+		{CVE: "CVE-3", Expires: "2019-05-31"},
+		{CVE: "CVE-4", Owner: "nobody"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired := whitelist.expire(time.Date(2019, 5, 31, 23, 0, 0, 0, time.UTC)); len(expired) != 0 {
+		t.Errorf("Expected the entry to apply until the end of the expiry day, got %v expired", expired)
+	}
+	if expired := whitelist.expire(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)); len(expired) != 1 || expired[0].CVE != "CVE-3" {
+		t.Errorf("Expected CVE-3 to expire, got %v", expired)
+	}
+
+	image := imageRef{registry: "registry.example.com", repository: "team/app", tag: "1.0"}
+	vs := []*clair.Vulnerability{
+		{Name: "CVE-1", FeatureName: "openssl", FeatureVersion: "1.0.2"},
+		{Name: "CVE-1", FeatureName: "openssl", FeatureVersion: "1.1.0"},
+		{Name: "CVE-1", FeatureName: "libssl", FeatureVersion: "1.0.2"},
+		{Name: "CVE-2", FeatureName: "bash"},
+		{Name: "CVE-3", FeatureName: "zlib"},
+	}
+	filtered, whitelisted, entries := partitionWhitelist(whitelist, vs, image)
+	if !reflect.DeepEqual(filtered, []*clair.Vulnerability{vs[1], vs[2], vs[4]}) {
+		t.Errorf("Unexpected filtered vulnerabilities %v", filtered)
+	}
+	if !reflect.DeepEqual(whitelisted, []*clair.Vulnerability{vs[0], vs[3]}) {
+		t.Errorf("Unexpected whitelisted vulnerabilities %v", whitelisted)
+	}
+	if entries[vs[3]] != whitelist.byCVE["CVE-2"][0] {
+		t.Errorf("Expected CVE-2 to be whitelisted by its entry, got %v", entries[vs[3]])
+	}
+
+	unused := whitelist.unused()
+	if len(unused) != 1 || unused[0].String() != "CVE-4 (nobody)" {
+		t.Errorf("Expected CVE-4 to be unused, got %v", unused)
+	}
+}